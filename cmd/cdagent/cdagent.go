@@ -7,14 +7,19 @@ import (
     "os/signal"
     "syscall"
     "flag"
-    //"sync"
+    "sync"
+    "sync/atomic"
     "fmt"
-    //"net/http"
+    "net/http"
     "net/url"
     "runtime"
-    "os/exec"
-    "context"
     "io/ioutil"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+    "errors"
+    "path/filepath"
+    "sort"
     "math/rand"
     "crypto/aes"
     "crypto/cipher"
@@ -24,15 +29,31 @@ import (
     "encoding/base64"
     //"github.com/gorilla/mux"
     "github.com/naoina/toml"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
     "gopkg.in/natefinch/lumberjack.v2"
     "github.com/ltkh/confd/internal/template"
+    "github.com/ltkh/confd/internal/cache"
+    "github.com/ltkh/confd/internal/changes"
+    "github.com/ltkh/confd/internal/status"
     "github.com/ltkh/confd/internal/client"
+    "github.com/ltkh/confd/internal/command"
     "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/diff"
+    "github.com/ltkh/confd/internal/file"
+    "github.com/ltkh/confd/internal/format"
+    "github.com/ltkh/confd/internal/merge"
+    "github.com/ltkh/confd/internal/secret"
 )
 
 var (
     Version      = "unknown"
-    KeyString    = "khuyg743878g8s2:b970m-z0"
+    // legacyKey decrypts values written before per-installation keys,
+    // it is only used to migrate them with -rotate-key
+    legacyKey    = "khuyg743878g8s2:b970m-z0"
+)
+
+const (
+    cipherPrefix = "v2:"
 )
 
 type Config struct {
@@ -45,9 +66,87 @@ type Global struct {
     ContentEncoding  string                  `toml:"content_encoding"`
     ChecksFile       string                  `toml:"checks_file"`
     PKey             string                  `toml:"pkey"`
+    ReloadDebounce   string                  `toml:"reload_debounce"`
+    CacheDir         string                  `toml:"cache_dir"`
+    Redact           []string                `toml:"redact"`
+    HistoryDir       string                  `toml:"history_dir"`
+    HistorySize      int                     `toml:"history_size"`
+    ChangeURL        string                  `toml:"change_url"`
+    Include          string                  `toml:"include"`
+    checks           []Check
+    ReloadGroups     map[string]*ReloadGroup `toml:"reload_groups"`
+    Functions        *Functions              `toml:"functions"`
+}
+
+// Functions is the policy of the template functions: the enabled groups
+// (none if unset), the allowed URL hosts (none if unset), HTTP methods
+// allowed besides GET and the bound of the total render time.
+type Functions struct {
+    Groups           []string                `toml:"groups"`
+    Hosts            []string                `toml:"hosts"`
+    Methods          []string                `toml:"methods"`
+    RenderTimeout    string                  `toml:"render_timeout"`
+}
+
+// policy returns the template policy of the functions, nil (all groups
+// disabled) if unset.
+func (f *Functions) policy() (*template.Policy, error) {
+    if f == nil {
+        return nil, nil
+    }
+    policy := &template.Policy{
+        Groups:  f.Groups,
+        Hosts:   f.Hosts,
+        Methods: f.Methods,
+    }
+    if f.RenderTimeout != "" {
+        timeout, err := time.ParseDuration(f.RenderTimeout)
+        if err != nil || timeout <= 0 {
+            return nil, fmt.Errorf("invalid render_timeout %q", f.RenderTimeout)
+        }
+        policy.Timeout = timeout
+    }
+    if err := policy.Validate(); err != nil {
+        return nil, err
+    }
+    return policy, nil
+}
+
+// srcPolicy returns the functions policy of the template with the src in
+// the config file, or the global one if no template has it. Without the
+// config file all groups are disabled.
+func srcPolicy(file, src string) (*template.Policy, error) {
+    if _, err := os.Stat(file); os.IsNotExist(err) {
+        return nil, nil
+    }
+    cfg, err := loadConfigFile(file, "", false)
+    if err != nil {
+        return nil, err
+    }
+    f := cfg.Global.Functions
+    for _, tl := range cfg.Templates {
+        if tl.Functions != nil && filepath.Clean(tl.Src) == filepath.Clean(src) {
+            f = tl.Functions
+            break
+        }
+    }
+    return f.policy()
+}
+
+// ReloadGroup is a reload command shared by templates, it runs once
+// for the changes of its templates made within the debounce window.
+type ReloadGroup struct {
+    ReloadCmd        string                  `toml:"reload_cmd"`
+    ReloadArgs       []string                `toml:"reload_args"`
+    ReloadTimeout    string                  `toml:"reload_timeout"`
+    ReloadRetries    int                     `toml:"reload_retries"`
+    RetryInterval    string                  `toml:"retry_interval"`
+    Debounce         string                  `toml:"debounce"`
+    MaxDelay         string                  `toml:"max_delay"`
 }
 
 type HTTPTemplate struct {
+    Name             string                  `toml:"name"`
     URLs             []string                `toml:"urls"`
     Path             string                  `toml:"path"`
     Hash             string                  `toml:"-"`
@@ -66,12 +165,86 @@ type HTTPTemplate struct {
     funcMap          map[string]interface{}
     Username         string                  `toml:"username"`
     Password         string                  `toml:"password"`
+    Mode             string                  `toml:"mode"`
+    Owner            string                  `toml:"owner"`
+    Group            string                  `toml:"group"`
+    Backup           string                  `toml:"backup"`
+    CheckArgs        []string                `toml:"check_args"`
+    CheckTimeout     string                  `toml:"check_timeout"`
+    CheckRetries     int                     `toml:"check_retries"`
+    ReloadArgs       []string                `toml:"reload_args"`
+    ReloadTimeout    string                  `toml:"reload_timeout"`
+    ReloadRetries    int                     `toml:"reload_retries"`
+    RetryInterval    string                  `toml:"retry_interval"`
+    Checks           []Check                 `toml:"checks"`
+    Sources          map[string]*Source      `toml:"sources"`
+    Merge            []string                `toml:"merge"`
+    MergeArrays      string                  `toml:"merge_arrays"`
+    MergeRules       map[string]string       `toml:"merge_rules"`
+    Each             string                  `toml:"each"`
+    Prune            bool                    `toml:"prune"`
+    ReloadGroup      string                  `toml:"reload_group"`
+    Rendered         bool                    `toml:"rendered"`
+    Functions        *Functions              `toml:"functions"`
+    Format           string                  `toml:"format"`
+    LintData         string                  `toml:"lint_data"`
+    policy           *template.Policy
+    group            *command.Debouncer
+    contHash         string
+    failedHash       string
+    rendered         []string
+    cache            *cache.Cache
+    cacheHash        string
+    cached           bool
+    noop             bool
+    changes          *changes.Reporter
+    status           *status.Registry
+    sync             chan struct{}
+    stop             chan struct{}
+    done             chan struct{}
+    client           *client.HttpClient
+    path             string
+    interval         time.Duration
+    spec             string
+    file             string
+    sourcesFailed    bool
+}
+
+// output is a file of the template rendered into temp,
+// or removed from dest if temp is empty.
+type output struct {
+    dest             string
+    temp             string
+    backup           string
+    existed          bool
+    old              []byte
+    cont             []byte
+}
+
+// Source is a named data source of a template, available in it as .sources.<name>.
+// Unset URLs, credentials, content encoding and timeout are taken from the template.
+type Source struct {
+    URLs             []string                `toml:"urls"`
+    Path             string                  `toml:"path"`
+    ContentEncoding  string                  `toml:"content_encoding"`
+    Headers          map[string]string       `toml:"headers"`
+    Username         string                  `toml:"username"`
+    Password         string                  `toml:"password"`
+    Timeout          string                  `toml:"timeout"`
+    client           *client.HttpClient
+    path             string
+    hash             string
+    data             interface{}
+    loaded           bool
 }
 
 type Checks struct {
     Checks           []Check                 `toml:"checks"`
 }
 
+// Check is a condition for installing the files of a template:
+// a key of the response (equal to value, if set), an existing file,
+// an HTTP endpoint answering with success within timeout.
 type Check struct {
     Key              string                  `toml:"key"`
     Value            string                  `toml:"value"`
@@ -80,6 +253,57 @@ type Check struct {
     Timeout          string                  `toml:"timeout"`
 }
 
+// delayedError is returned when the checks of a template do not pass yet.
+type delayedError struct {
+    reason           error
+}
+
+func (e *delayedError) Error() string {
+    return fmt.Sprintf("apply delayed: %v", e.reason)
+}
+
+// Eval returns the reason why the check does not pass, nil if it passes.
+func (c Check) Eval(jsn interface{}) error {
+    if c.Key != "" {
+        v, ok := template.LookupPath(c.Key, jsn)
+        if !ok {
+            return fmt.Errorf("key %s not found", c.Key)
+        }
+        if c.Value != "" && fmt.Sprintf("%v", v) != c.Value {
+            return fmt.Errorf("key %s is %v, not %s", c.Key, v, c.Value)
+        }
+    }
+
+    if c.File != "" {
+        if _, err := os.Stat(c.File); err != nil {
+            return err
+        }
+    }
+
+    if c.Http != "" {
+        timeout := 5 * time.Second
+        if c.Timeout != "" {
+            var err error
+            if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+                return fmt.Errorf("check timeout: %v", err)
+            }
+        }
+
+        client := &http.Client{ Timeout: timeout }
+        resp, err := client.Get(c.Http)
+        if err != nil {
+            return err
+        }
+        resp.Body.Close()
+
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+            return fmt.Errorf("when request to [%s] received status code: %d", c.Http, resp.StatusCode)
+        }
+    }
+
+    return nil
+}
+
 type Resp struct {
     Status           string                  `json:"status"`
     Error            string                  `json:"error,omitempty"`
@@ -87,246 +311,1923 @@ type Resp struct {
     Data             interface{}             `json:"data,omitempty"`
 }
 
-func encrypt(text string) (string, error) {
-    block, err := aes.NewCipher([]byte(KeyString))
+// encrypt returns the text encrypted with the installation key
+// in the current "v2:" format.
+func encrypt(key *secret.Key, text string) (string, error) {
+    if key == nil {
+        return "", fmt.Errorf("no key configured: set -key.file, global pkey or CDAGENT_KEY")
+    }
+    value, err := key.Seal(text)
+    if err != nil {
+        return "", err
+    }
+    return cipherPrefix + value, nil
+}
+
+// decrypt accepts both the "v2:" format and legacy values.
+func decrypt(key *secret.Key, text string) (string, error) {
+    if strings.HasPrefix(text, cipherPrefix) {
+        if key == nil {
+            return "", fmt.Errorf("no key configured: set -key.file, global pkey or CDAGENT_KEY")
+        }
+        return key.Open(strings.TrimPrefix(text, cipherPrefix))
+    }
+    return decryptLegacy(text)
+}
+
+// isLegacy reports whether the value can be a legacy ciphertext: strict
+// base64 decrypted to printable UTF-8 text. Plain passwords are not.
+func isLegacy(text string) bool {
+    if text == "" {
+        return false
+    }
+    if _, err := base64.StdEncoding.Strict().DecodeString(text); err != nil {
+        return false
+    }
+    plain, err := decryptLegacy(text)
+    if err != nil || !utf8.ValidString(plain) {
+        return false
+    }
+    for _, r := range plain {
+        if !unicode.IsPrint(r) {
+            return false
+        }
+    }
+    return true
+}
+
+func decryptLegacy(text string) (string, error) {
+    block, err := aes.NewCipher([]byte(legacyKey))
+    if err != nil {
+        return "", err
+    }
+    cipherText, err := base64.StdEncoding.DecodeString(text)
+    if err != nil {
+        return "", err
+    }
+    bytes := []byte{35, 46, 57, 24, 85, 35, 24, 74, 87, 35, 88, 98, 66, 32, 14, 05}
+    cfb := cipher.NewCFBDecrypter(block, bytes)
+    plainText := make([]byte, len(cipherText))
+    cfb.XORKeyStream(plainText, cipherText)
+    return string(plainText), nil
+}
+
+// readKey returns the key from the file given on the command line,
+// the file set by global pkey of the config file cfg (relative to
+// its directory) or the CDAGENT_KEY environment variable.
+func readKey(file, cfg, pkey string) (*secret.Key, error) {
+    if file == "" && pkey != "" {
+        file = relativeTo(cfg, pkey)
+    }
+    return secret.ReadKey(file, "CDAGENT_KEY")
+}
+
+// rotateKey re-encrypts the passwords of the config file with the new key,
+// keeping the rest of the file as is. It returns the number of values replaced.
+func rotateKey(name string, oldKey, newKey *secret.Key) (int, error) {
+    content, err := ioutil.ReadFile(name)
+    if err != nil {
+        return 0, err
+    }
+
+    var cfg Config
+    if err := toml.Unmarshal(content, &cfg); err != nil {
+        return 0, err
+    }
+
+    text := string(content)
+    count := 0
+    done := map[string]bool{}
+
+    for _, tmpl := range cfg.Templates {
+        passwords := []string{tmpl.Password}
+        for _, src := range tmpl.Sources {
+            passwords = append(passwords, src.Password)
+        }
+
+        for _, password := range passwords {
+            if password == "" || done[password] {
+                continue
+            }
+            done[password] = true
+
+            // Незашифрованные значения не мигрируются
+            if !strings.HasPrefix(password, cipherPrefix) && !isLegacy(password) {
+                log.Printf("[warn] %s: template %s: password is not encrypted, it is skipped", name, tmpl.Dest)
+                continue
+            }
+
+            passwd, err := decrypt(oldKey, password)
+            if err != nil {
+                return 0, fmt.Errorf("template %s: %v", tmpl.Dest, err)
+            }
+
+            value, err := encrypt(newKey, passwd)
+            if err != nil {
+                return 0, err
+            }
+
+            // Базовые "..." и литеральные '...' строки TOML
+            replaced := 0
+            for _, q := range []string{"\"", "'"} {
+                n := strings.Count(text, q+password+q)
+                text = strings.Replace(text, q+password+q, q+value+q, -1)
+                replaced += n
+            }
+            if replaced == 0 {
+                return 0, fmt.Errorf("template %s: password is not a plain TOML string, it cannot be re-encrypted", tmpl.Dest)
+            }
+            count += replaced
+        }
+    }
+
+    if count == 0 {
+        return 0, nil
+    }
+
+    // Временный файл получает права и владельца исходного
+    attrs, err := file.GetAttrs(name, file.Options{})
+    if err != nil {
+        return 0, err
+    }
+    temp, err := file.WriteTemp(name, "", []byte(text), attrs)
+    if err != nil {
+        return 0, err
+    }
+    if err := file.Install(temp, name); err != nil {
+        os.Remove(temp)
+        return 0, err
+    }
+
+    return count, nil
+}
+
+func encodeResp(resp *Resp) []byte {
+    jsn, err := json.Marshal(resp)
+    if err != nil {
+        return encodeResp(&Resp{Status:"error", Error:err.Error(), Data:make([]int, 0)})
+    }
+    return jsn
+}
+
+func randURLs(urls []string) []string {
+    rand.Seed(time.Now().UnixNano())
+    rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+    return urls
+}
+
+// render returns the rendered contents by dest. With each set, the file name
+// of dest and src are rendered per element of the selected collection
+// with .key, .value and .root (the whole response).
+func (t *HTTPTemplate) render(jsn interface{}) ([]string, map[string][]byte, error) {
+
+    // Шаблон уже отрисован cdserver
+    if t.Rendered {
+        cont, _ := jsn.(string)
+        return []string{t.Dest}, map[string][]byte{t.Dest: []byte(cont)}, nil
+    }
+
+    if t.SrcMatch == "" {
+        t.SrcMatch = t.Src
+    }
+
+    if t.Each == "" {
+        cont, err := template.New(t.Src).WithPolicy(t.policy).ParseGlob(t.SrcMatch, jsn)
+        if err != nil {
+            return nil, nil, err
+        }
+        return []string{t.Dest}, map[string][]byte{t.Dest: cont}, nil
+    }
+
+    dir := filepath.Dir(t.Dest)
+    if strings.Contains(dir, "{{") {
+        return nil, nil, fmt.Errorf("only the file name of dest can be a template")
+    }
+
+    items, err := template.Select(t.Each, jsn)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var dests []string
+    conts := map[string][]byte{}
+
+    for _, item := range items {
+        data := map[string]interface{}{
+            "key":   item.Key,
+            "value": item.Value,
+            "root":  jsn,
+        }
+
+        name, err := template.New(t.Dest).Execute(filepath.Base(t.Dest), data)
+        if err != nil {
+            return nil, nil, fmt.Errorf("dest for %q: %v", item.Key, err)
+        }
+
+        base := strings.TrimSpace(string(name))
+        if base == "" || base == "." || base == ".." || strings.ContainsAny(base, `/\`) || base == filepath.Base(t.manifest()) {
+            return nil, nil, fmt.Errorf("dest for %q: invalid file name %q", item.Key, base)
+        }
+
+        dest := filepath.Join(dir, base)
+        if _, ok := conts[dest]; ok {
+            return nil, nil, fmt.Errorf("dest for %q: %s is already rendered", item.Key, dest)
+        }
+
+        cont, err := template.New(t.Src).WithPolicy(t.policy).ParseGlob(t.SrcMatch, data)
+        if err != nil {
+            return nil, nil, fmt.Errorf("%s: %v", dest, err)
+        }
+
+        dests = append(dests, dest)
+        conts[dest] = cont
+    }
+
+    return dests, conts, nil
+}
+
+// CreateConf renders the template and writes every result that differs
+// from its dest into a temporary file next to it. With prune set, files
+// created earlier and no longer rendered are returned for removal.
+func (t *HTTPTemplate) CreateConf(jsn interface{}) (int, []*output, error) {
+
+    dests, conts, err := t.render(jsn)
+    if err != nil {
+        return 3, nil, fmt.Errorf("generating config: %v", err)
+    }
+    if err := t.validate(dests, conts); err != nil {
+        return 3, nil, err
+    }
+    t.rendered = dests
+
+    if t.Each == "" {
+        t.contHash = config.GetHash(conts[t.Dest])
+    } else {
+        var all []byte
+        for _, dest := range dests {
+            all = append(all, dest+"\n"...)
+            all = append(all, conts[dest]...)
+        }
+        t.contHash = config.GetHash(all)
+    }
+
+    // Содержимое, после которого reload_cmd завершился ошибкой, не применяем повторно
+    if t.contHash == t.failedHash {
+        log.Printf("[warn] %s: content %s is skipped, reload_cmd failed with it, waiting for the data to change", t.target(), t.contHash)
+        return 0, nil, nil
+    }
+
+    var outputs []*output
+
+    for _, dest := range dests {
+        o, err := t.writeTemp(dest, conts[dest])
+        if err != nil {
+            removeTemps(outputs)
+            return 4, nil, err
+        }
+        if o != nil {
+            outputs = append(outputs, o)
+        }
+    }
+
+    if t.Each != "" && t.Prune {
+        owned, err := t.readManifest()
+        if err != nil {
+            removeTemps(outputs)
+            return 4, nil, err
+        }
+        for _, name := range owned {
+            dest := filepath.Join(filepath.Dir(t.Dest), name)
+            if _, ok := conts[dest]; ok {
+                continue
+            }
+            old, err := ioutil.ReadFile(dest)
+            if err != nil {
+                continue
+            }
+            outputs = append(outputs, &output{ dest: dest, old: old })
+        }
+    }
+
+    if len(outputs) == 0 {
+        if t.Each != "" {
+            if err := t.writeManifest(dests); err != nil {
+                return 4, nil, err
+            }
+        }
+        return 0, nil, nil
+    }
+
+    return 1, outputs, nil
+}
+
+// validate checks the syntax of the rendered contents in the format of the template.
+func (t *HTTPTemplate) validate(dests []string, conts map[string][]byte) error {
+    if t.Format == "" {
+        return nil
+    }
+    for _, dest := range dests {
+        if err := format.Validate(t.Format, conts[dest]); err != nil {
+            return fmt.Errorf("generating config: %s is not valid %s: %v", dest, t.Format, err)
+        }
+    }
+    return nil
+}
+
+// writeTemp writes the content into a temporary file next to dest,
+// it returns nil if dest already has this content.
+func (t *HTTPTemplate) writeTemp(dest string, cont []byte) (*output, error) {
+
+    var old []byte
+
+    if _, err := os.Stat(dest); err == nil {
+        conf, err := ioutil.ReadFile(dest)
+        if err != nil {
+            return nil, fmt.Errorf("reading config file %s: %v", dest, err)
+        }
+        if config.GetHash(conf) == config.GetHash(cont) {
+            return nil, nil
+        }
+        old = conf
+    } else if !os.IsNotExist(err) {
+        return nil, fmt.Errorf("reading config file status %s: %v", dest, err)
+    }
+
+    attrs, err := file.GetAttrs(dest, file.Options{ Mode: t.Mode, Owner: t.Owner, Group: t.Group })
+    if err != nil {
+        return nil, fmt.Errorf("config file %s: %v", dest, err)
+    }
+
+    temp := ""
+    if t.Each == "" {
+        temp = t.Temp
+    }
+
+    temp, err = file.WriteTemp(dest, temp, cont, attrs)
+    if err != nil {
+        return nil, fmt.Errorf("writing config file %s: %v", dest, err)
+    }
+
+    return &output{ dest: dest, temp: temp, old: old, cont: cont }, nil
+}
+
+func removeTemps(outputs []*output) {
+    for _, o := range outputs {
+        if o.temp != "" {
+            os.Remove(o.temp)
+        }
+    }
+}
+
+// target returns dest or, with each set, the directory of the files.
+func (t *HTTPTemplate) target() string {
+    if t.Each != "" {
+        return filepath.Dir(t.Dest)
+    }
+    return t.Dest
+}
+
+// manifest returns the file listing the files created by the template with each set.
+func (t *HTTPTemplate) manifest() string {
+    return filepath.Join(filepath.Dir(t.Dest), ".cdagent."+config.GetHash([]byte(t.Dest))+".list")
+}
+
+func (t *HTTPTemplate) readManifest() ([]string, error) {
+    data, err := ioutil.ReadFile(t.manifest())
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    var names []string
+    for _, name := range strings.Split(string(data), "\n") {
+        if name = strings.TrimSpace(name); name != "" {
+            names = append(names, name)
+        }
+    }
+    return names, nil
+}
+
+func (t *HTTPTemplate) writeManifest(dests []string) error {
+    var data []byte
+    for _, dest := range dests {
+        data = append(data, filepath.Base(dest)+"\n"...)
+    }
+
+    name := t.manifest()
+    if conf, err := ioutil.ReadFile(name); err == nil && string(conf) == string(data) {
+        return nil
+    }
+
+    attrs, err := file.GetAttrs(name, file.Options{})
+    if err != nil {
+        return err
+    }
+    temp, err := file.WriteTemp(name, "", data, attrs)
+    if err != nil {
+        return err
+    }
+    if err := file.Install(temp, name); err != nil {
+        os.Remove(temp)
+        return err
+    }
+    return nil
+}
+
+// expand substitutes {{.src}} (the rendered temporary file)
+// and {{.dest}} in check and reload commands.
+func (t *HTTPTemplate) expand(cmd, src, dest string) (string, error) {
+    out, err := template.New(cmd).Execute(cmd, map[string]interface{}{
+        "src":  src,
+        "dest": dest,
+    })
+    if err != nil {
+        return "", err
+    }
+    return string(out), nil
+}
+
+// usesSrc reports whether the command refers to the rendered file.
+func usesSrc(cmd string, args []string) bool {
+    for _, a := range append([]string{cmd}, args...) {
+        if strings.Contains(a, ".src") || strings.Contains(a, "CONFD_SRC") {
+            return true
+        }
+    }
+    return false
+}
+
+// newCommand returns the check or reload command of the template.
+// The command also gets CONFD_SRC, CONFD_DEST and CONFD_HASH in its environment.
+func (t *HTTPTemplate) newCommand(kind, src, dest string) (*command.Command, error) {
+    cmd := &command.Command{
+        Env: map[string]string{
+            "CONFD_SRC":  src,
+            "CONFD_DEST": dest,
+            "CONFD_HASH": t.contHash,
+        },
+    }
+
+    var line, timeout string
+    var args []string
+
+    switch kind {
+        case "check":
+            line, args, timeout, cmd.Retries = t.CheckCmd, t.CheckArgs, t.CheckTimeout, t.CheckRetries
+        case "reload":
+            line, args, timeout, cmd.Retries = t.ReloadCmd, t.ReloadArgs, t.ReloadTimeout, t.ReloadRetries
+    }
+
+    if len(args) == 0 && line == "" {
+        return nil, nil
+    }
+
+    var err error
+    if cmd.Cmd, err = t.expand(line, src, dest); err != nil {
+        return nil, fmt.Errorf("%s command: %v", kind, err)
+    }
+    for _, arg := range args {
+        a, err := t.expand(arg, src, dest)
+        if err != nil {
+            return nil, fmt.Errorf("%s command: %v", kind, err)
+        }
+        cmd.Args = append(cmd.Args, a)
+    }
+
+    if timeout != "" {
+        if cmd.Timeout, err = time.ParseDuration(timeout); err != nil {
+            return nil, fmt.Errorf("%s timeout: %v", kind, err)
+        }
+    }
+
+    cmd.RetryInterval = time.Second
+    if t.RetryInterval != "" {
+        if cmd.RetryInterval, err = time.ParseDuration(t.RetryInterval); err != nil {
+            return nil, fmt.Errorf("retry interval: %v", err)
+        }
+    }
+
+    return cmd, nil
+}
+
+// fetch requests the source, it returns true if its data has changed.
+func (s *Source) fetch(name string, t *HTTPTemplate) (bool, error) {
+    httpConfig := client.HttpConfig{
+        URLs: s.URLs,
+        Headers: s.Headers,
+        ContentEncoding: s.ContentEncoding,
+        Username: s.Username,
+        Password: s.Password,
+    }
+
+    resp, err := s.client.NewRequest("GET", s.path, s.hash, nil, httpConfig)
+    if err != nil {
+        return false, fmt.Errorf("source %s: %v", name, err)
+    }
+
+    switch resp.StatusCode {
+        case 200:
+        case 204:
+            return false, nil
+        case 404:
+            // Отсутствующие данные доступны в шаблоне как пустое значение
+            changed := !s.loaded || s.data != nil
+            s.data, s.hash, s.loaded = nil, "", true
+            return changed, nil
+        default:
+            return false, fmt.Errorf("source %s: when request to [%s] received status code: %d", name, s.path, resp.StatusCode)
+    }
+
+    var data interface{}
+    if err := json.Unmarshal(resp.Body, &data); err != nil {
+        return false, fmt.Errorf("source %s: %v", name, err)
+    }
+
+    s.data, s.hash, s.loaded = data, config.GetHash(resp.Body), true
+
+    if t.cache != nil && !t.noop {
+        entry := cache.Entry{ Path: s.path, Hash: s.hash, Time: time.Now(), Body: resp.Body }
+        if err := t.cache.Save(t.cacheKey("source:"+name+"\n"+s.path), entry); err != nil {
+            log.Printf("[warn] caching response of %s: %v", s.path, err)
+        }
+    }
+
+    return true, nil
+}
+
+// fetchSources requests the sources of the template concurrently and
+// renders it when the data of any of them has changed.
+func (t *HTTPTemplate) fetchSources(plugin string) error {
+    names := make([]string, 0, len(t.Sources))
+    for name := range t.Sources {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    changed := make([]bool, len(names))
+    errs := make([]error, len(names))
+
+    var wg sync.WaitGroup
+    for i, name := range names {
+        wg.Add(1)
+        go func(i int, name string) {
+            defer wg.Done()
+            changed[i], errs[i] = t.Sources[name].fetch(name, t)
+        }(i, name)
+    }
+    wg.Wait()
+
+    render := t.sourcesFailed
+    cached := false
+
+    for i, name := range names {
+        src := t.Sources[name]
+
+        if errs[i] != nil {
+            if t.cache == nil {
+                return errs[i]
+            }
+            // Без ответа используем последние полученные данные
+            if !src.loaded {
+                entry, err := t.cache.Load(t.cacheKey("source:"+name+"\n"+src.path))
+                if err != nil {
+                    return errs[i]
+                }
+                if err := json.Unmarshal(entry.Body, &src.data); err != nil {
+                    return fmt.Errorf("%v; reading cached response: %v", errs[i], err)
+                }
+                src.hash, src.loaded = entry.Hash, true
+                changed[i] = true
+                log.Printf("[warn] %s: %v, using cached response of %s from %s", t.Dest, errs[i], src.path, entry.Time.Format(time.RFC3339))
+            }
+            cached = true
+        }
+
+        render = render || changed[i]
+    }
+
+    if !cached && t.cached {
+        log.Printf("[info] %s: cdserver is available again, cached response is no longer used", t.Dest)
+    }
+    t.setCached(cached)
+
+    if !render {
+        return nil
+    }
+
+    sources := map[string]interface{}{}
+    hashes := ""
+    for _, name := range names {
+        sources[name] = t.Sources[name].data
+        hashes += t.Sources[name].hash
+    }
+    t.status.Fetched(t.Name, config.GetHash([]byte(hashes)))
+
+    root, err := t.sourcesRoot(sources)
+    if err != nil {
+        return err
+    }
+
+    err = t.apply(root, plugin)
+    t.sourcesFailed = err != nil
+    return err
+}
+
+// sourcesRoot returns the data of the template with sources.
+func (t *HTTPTemplate) sourcesRoot(sources map[string]interface{}) (map[string]interface{}, error) {
+    root := map[string]interface{}{ "sources": sources }
+
+    // Источники объединяются в порядке списка merge
+    if len(t.Merge) > 0 {
+        docs := make([]interface{}, 0, len(t.Merge))
+        for _, name := range t.Merge {
+            docs = append(docs, sources[name])
+        }
+        merged, err := merge.Merge(docs, merge.Options{ Arrays: t.MergeArrays, Rules: t.MergeRules })
+        if err != nil {
+            return nil, err
+        }
+        root["merged"] = merged
+    }
+
+    return root, nil
+}
+
+func (t *HTTPTemplate) CreateTemplate(httpClient *client.HttpClient, path, plugin string) error {
+
+    if len(t.Sources) > 0 {
+        return t.fetchSources(plugin)
+    }
+
+    httpConfig := client.HttpConfig{
+        URLs: t.URLs,
+        ContentEncoding: t.ContentEncoding,
+        Username: t.Username,
+        Password: t.Password,
+    }
+
+    resp, err := httpClient.NewRequest("GET", path, t.Hash, nil, httpConfig)
+    if err != nil {
+        if t.cache != nil {
+            return t.fromCache(path, plugin, err)
+        }
+        return err
+    }
+
+    if resp.StatusCode == 204 {
+        t.status.Fetched(t.Name, "")
+        t.setCached(false)
+        return nil
+    }
+
+    if resp.StatusCode == 404 {
+        if !t.Create || t.noop {
+            return fmt.Errorf("when request to [%s] received status code: 404", path)
+        }
+
+        // parse url path
+        u, err := url.Parse(path)
+        if err != nil {
+            return err
+        }
+
+        // Созданный каталог отрисуется при следующем запросе
+        presp, err := httpClient.NewRequest("PUT", u.Path, "", []byte("dir=true"), httpConfig)
+        if err != nil {
+            return fmt.Errorf("creating [%s]: %v", u.Path, err)
+        }
+        if presp.StatusCode < 200 || presp.StatusCode > 299 {
+            return fmt.Errorf("creating [%s]: received status code: %d", u.Path, presp.StatusCode)
+        }
+        log.Printf("[info] %s: [%s] is not found, created", t.Dest, u.Path)
+        return nil
+    }
+
+    if resp.StatusCode != 200 {
+        return fmt.Errorf("when request to [%s] received status code: %d", path, resp.StatusCode)
+    }
+
+    if t.Modified {
+        t.Hash = config.GetHash(resp.Body)
+    }
+
+    t.status.Fetched(t.Name, config.GetHash(resp.Body))
+
+    var jsn interface{}
+    body := resp.Body
+    if t.Rendered {
+        // Отрисованный файл хранится в кэше строкой JSON
+        jsn = string(resp.Body)
+        body, _ = json.Marshal(jsn)
+    } else if err := json.Unmarshal(resp.Body, &jsn); err != nil {
+        t.report(plugin, 1)
+        return err
+    }
+
+    if t.cache != nil && !t.noop {
+        hash := config.GetHash(resp.Body)
+        if hash != t.cacheHash {
+            entry := cache.Entry{ Path: path, Hash: hash, Time: time.Now(), Body: body }
+            if err := t.cache.Save(t.cacheKey(path), entry); err != nil {
+                log.Printf("[warn] caching response of %s: %v", path, err)
+            } else {
+                t.cacheHash = hash
+            }
+        }
+    }
+
+    if t.cached {
+        log.Printf("[info] %s: cdserver is available again, cached response is no longer used", t.Dest)
+        t.setCached(false)
+    }
+
+    return t.apply(jsn, plugin)
+}
+
+// fromCache renders the template from the last successful response
+// when no URL is available. It is done once until a URL responds again.
+func (t *HTTPTemplate) fromCache(path, plugin string, reqErr error) error {
+    if t.cached {
+        return reqErr
+    }
+
+    entry, err := t.cache.Load(t.cacheKey(path))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return reqErr
+        }
+        return fmt.Errorf("%v; reading cached response: %v", reqErr, err)
+    }
+
+    var jsn interface{}
+    if err := json.Unmarshal(entry.Body, &jsn); err != nil {
+        return fmt.Errorf("%v; reading cached response: %v", reqErr, err)
+    }
+
+    t.setCached(true)
+    t.cacheHash = entry.Hash
+    if t.Modified {
+        t.Hash = entry.Hash
+    }
+
+    log.Printf("[warn] %s: %v, using cached response of %s from %s", t.Dest, reqErr, path, entry.Time.Format(time.RFC3339))
+
+    return t.apply(jsn, plugin)
+}
+
+// setCached marks whether the template is rendered from the cached response.
+func (t *HTTPTemplate) setCached(value bool) {
+    if t.cached != value {
+        t.cached = value
+        t.status.Cached(t.Name, value)
+    }
+}
+
+// cacheKey returns the key of the cached response.
+func (t *HTTPTemplate) cacheKey(path string) string {
+    return path + "\n" + t.Dest
+}
+
+// report prints the status of the template for the telegraf and windows plugins.
+func (t *HTTPTemplate) report(plugin string, succ int) {
+    if plugin != "telegraf" && plugin != "windows" {
+        return
+    }
+    if t.cached {
+        fmt.Printf("confd,src=%s,dest=%s success=%d,cached=1\n", t.Src, t.Dest, succ)
+        return
+    }
+    fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, succ)
+}
+
+// preview prints the diffs between the dest files and the rendered
+// contents without changing anything.
+func (t *HTTPTemplate) preview(jsn interface{}) error {
+
+    dests, conts, err := t.render(jsn)
+    if err != nil {
+        return fmt.Errorf("generating config: %v", err)
+    }
+    if err := t.validate(dests, conts); err != nil {
+        return err
+    }
+
+    if t.Each != "" && t.Prune {
+        owned, err := t.readManifest()
+        if err != nil {
+            return err
+        }
+        for _, name := range owned {
+            dest := filepath.Join(filepath.Dir(t.Dest), name)
+            if _, ok := conts[dest]; ok {
+                continue
+            }
+            if _, err := os.Stat(dest); err == nil {
+                dests = append(dests, dest)
+            }
+        }
+    }
+
+    var out strings.Builder
+
+    for _, dest := range dests {
+        oldName, newName := dest, dest
+
+        cont, ok := conts[dest]
+        if !ok {
+            newName = "/dev/null"
+        }
+
+        old, err := ioutil.ReadFile(dest)
+        if err != nil {
+            if !os.IsNotExist(err) {
+                return fmt.Errorf("reading config file %s: %v", dest, err)
+            }
+            oldName = "/dev/null"
+        }
+
+        d, err := t.changes.Diff(oldName, newName, old, cont)
+        if err != nil {
+            return err
+        }
+        out.WriteString(d)
+    }
+
+    fmt.Print(out.String())
+
+    return nil
+}
+
+// cachedData returns the data of the template from the cached responses,
+// nil if some of them is not cached.
+func (t *HTTPTemplate) cachedData() (interface{}, error) {
+    if t.cache == nil {
+        return nil, nil
+    }
+
+    load := func(key string) (interface{}, error) {
+        entry, err := t.cache.Load(t.cacheKey(key))
+        if err != nil {
+            if os.IsNotExist(err) {
+                return nil, nil
+            }
+            return nil, err
+        }
+        var jsn interface{}
+        if err := json.Unmarshal(entry.Body, &jsn); err != nil {
+            return nil, fmt.Errorf("reading cached response of %s: %v", entry.Path, err)
+        }
+        return jsn, nil
+    }
+
+    if len(t.Sources) == 0 {
+        return load(t.path)
+    }
+
+    sources := map[string]interface{}{}
+    for name, src := range t.Sources {
+        data, err := load("source:"+name+"\n"+src.path)
+        if err != nil || data == nil {
+            return nil, err
+        }
+        sources[name] = data
+    }
+    return t.sourcesRoot(sources)
+}
+
+// lint checks the template files and renders the cached data, or the
+// lint_data sample without it, reporting keys missing in the data and
+// invalid formats.
+func (t *HTTPTemplate) lint() []string {
+    if t.Rendered {
+        return nil
+    }
+
+    problems, err := template.Lint(t.Src, t.SrcMatch, t.policy)
+    if err != nil {
+        return []string{fmt.Sprintf("%s: %v", t.Src, err)}
+    }
+    if len(problems) > 0 {
+        return problems
+    }
+
+    jsn, err := t.cachedData()
+    if err != nil {
+        return []string{fmt.Sprintf("%s: %v", t.Dest, err)}
+    }
+    from := "cached data"
+    if jsn == nil && t.LintData != "" {
+        data, err := ioutil.ReadFile(t.LintData)
+        if err != nil {
+            return []string{fmt.Sprintf("%s: lint_data: %v", t.Dest, err)}
+        }
+        if err := json.Unmarshal(data, &jsn); err != nil {
+            return []string{fmt.Sprintf("%s: parsing json file: %v", t.LintData, err)}
+        }
+        from = t.LintData
+    }
+    if jsn == nil {
+        log.Printf("[warn] %s: missing keys are not checked, no cached data or lint_data", t.Dest)
+        return nil
+    }
+
+    dests, conts, err := t.render(jsn)
+    if err != nil {
+        return []string{fmt.Sprintf("%s: rendering %s: %v", t.Src, from, err)}
+    }
+    for _, dest := range dests {
+        for _, line := range template.MissingKeys(conts[dest]) {
+            problems = append(problems, fmt.Sprintf("%s:%d: <no value>, key is missing in %s", dest, line, from))
+        }
+    }
+    if err := t.validate(dests, conts); err != nil {
+        problems = append(problems, err.Error())
+    }
+
+    return problems
+}
+
+// apply renders the response and installs the changed files.
+func (t *HTTPTemplate) apply(jsn interface{}, plugin string) error {
+
+    if t.noop {
+        return t.preview(jsn)
+    }
+
+    for _, c := range t.Checks {
+        if err := c.Eval(jsn); err != nil {
+            // Данные нужно получить заново при следующем запуске
+            t.Hash = ""
+            t.report(plugin, 6)
+            return &delayedError{ reason: err }
+        }
+    }
+
+    succ, outputs, err := t.CreateConf(jsn)
+    if err != nil {
+        t.report(plugin, succ)
+        return err
+    }
+
+    if succ == 1 {
+        for _, o := range outputs {
+            if o.temp == "" {
+                continue
+            }
+            cmd, err := t.newCommand("check", o.temp, o.dest)
+            if err == nil && cmd != nil {
+                _, err = cmd.Run()
+            }
+            if err != nil {
+                removeTemps(outputs)
+                t.report(plugin, 3)
+                return err
+            }
+        }
+
+        // Сохраняем предыдущие версии для отката
+        for _, o := range outputs {
+            o.backup = t.backupFile(o.dest)
+            if _, err := os.Stat(o.dest); err == nil {
+                o.existed = true
+                if err := file.Copy(o.dest, o.backup); err != nil {
+                    removeTemps(outputs)
+                    return fmt.Errorf("creating backup %s: %v", o.backup, err)
+                }
+            }
+        }
+
+        for i, o := range outputs {
+            if o.temp != "" {
+                err = file.Install(o.temp, o.dest)
+            } else {
+                err = os.Remove(o.dest)
+            }
+            if err != nil {
+                removeTemps(outputs[i:])
+                if rerr := t.restore(outputs[:i]); rerr != nil {
+                    log.Printf("[error] %v", rerr)
+                }
+                t.report(plugin, 3)
+                return err
+            }
+            if o.temp == "" {
+                log.Printf("[info] %s: removed", o.dest)
+            }
+        }
+
+        if err, rerr := t.reload(outputs); err != nil {
+            t.failedHash = t.contHash
+            t.report(plugin, 5)
+            if rerr != nil {
+                return fmt.Errorf("reload failed: %v; rollback failed: %v", err, rerr)
+            }
+            return fmt.Errorf("reload failed, previous version of %s restored, content %s is skipped until it changes: %v", t.target(), t.contHash, err)
+        }
+
+        t.failedHash = ""
+        t.status.Reloaded(t.Name)
+
+        for _, o := range outputs {
+            // Резервные копии удаленных файлов больше не нужны
+            if o.temp == "" && o.existed {
+                os.Remove(o.backup)
+            }
+            t.changes.Report(t.Src, o.dest, o.old, o.cont)
+        }
+
+        if t.Each != "" {
+            if err := t.writeManifest(t.rendered); err != nil {
+                return fmt.Errorf("writing %s: %v", t.manifest(), err)
+            }
+        }
+
+        t.report(plugin, 1)
+
+        return nil
+    }
+
+    t.report(plugin, 0)
+
+    return nil
+}
+
+// backupFile returns the file keeping the previous version of dest.
+func (t *HTTPTemplate) backupFile(dest string) string {
+    if t.Backup != "" && t.Each == "" {
+        return t.Backup
+    }
+    return filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".bak")
+}
+
+// restore returns the files to their previous versions.
+func (t *HTTPTemplate) restore(outputs []*output) error {
+    for _, o := range outputs {
+        if o.existed {
+            if err := file.Copy(o.backup, o.dest); err != nil {
+                return err
+            }
+        } else if o.temp != "" {
+            if err := os.Remove(o.dest); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+        }
+        log.Printf("[warn] %s: previous version restored", o.dest)
+    }
+    return nil
+}
+
+// reload runs the reload command of the template or of its reload group.
+// When it fails, the previous versions are restored and reloaded once,
+// for a group after all its templates are restored.
+func (t *HTTPTemplate) reload(outputs []*output) (err, rerr error) {
+    restore := func() error {
+        return t.restore(outputs)
+    }
+
+    if t.group != nil {
+        return t.group.Run(restore)
+    }
+
+    cmd, err := t.newCommand("reload", t.target(), t.target())
+    if err != nil || cmd == nil {
+        return err, nil
+    }
+    if _, err = cmd.Run(); err == nil {
+        return nil, nil
+    }
+
+    if rerr = restore(); rerr == nil {
+        _, rerr = cmd.Run()
+    }
+    return err, rerr
+}
+
+// newGroup returns the debounced command of the reload group.
+func newGroup(name string, g *ReloadGroup, debounce string) (*command.Debouncer, error) {
+    if g.ReloadCmd == "" && len(g.ReloadArgs) == 0 {
+        return nil, fmt.Errorf("reload group %s: no reload_cmd", name)
+    }
+
+    cmd := &command.Command{
+        Cmd:     g.ReloadCmd,
+        Args:    g.ReloadArgs,
+        Retries: g.ReloadRetries,
+        Env:     map[string]string{ "CONFD_GROUP": name },
+    }
+
+    var err error
+    if g.ReloadTimeout != "" {
+        if cmd.Timeout, err = time.ParseDuration(g.ReloadTimeout); err != nil {
+            return nil, fmt.Errorf("reload group %s: reload timeout: %v", name, err)
+        }
+    }
+
+    cmd.RetryInterval = time.Second
+    if g.RetryInterval != "" {
+        if cmd.RetryInterval, err = time.ParseDuration(g.RetryInterval); err != nil {
+            return nil, fmt.Errorf("reload group %s: retry interval: %v", name, err)
+        }
+    }
+
+    if g.Debounce != "" {
+        debounce = g.Debounce
+    }
+    window := time.Second
+    if debounce != "" {
+        if window, err = time.ParseDuration(debounce); err != nil {
+            return nil, fmt.Errorf("reload group %s: debounce: %v", name, err)
+        }
+    }
+
+    // По умолчанию изменения откладывают запуск не более чем на 10 окон
+    maxDelay := 10 * window
+    if g.MaxDelay != "" {
+        if maxDelay, err = time.ParseDuration(g.MaxDelay); err != nil {
+            return nil, fmt.Errorf("reload group %s: max delay: %v", name, err)
+        }
+    }
+
+    return command.NewDebouncer(cmd, window, maxDelay), nil
+}
+
+// run applies the template every interval or when its sync is requested
+// until it is stopped.
+func (t *HTTPTemplate) run(plugin string) {
+    defer close(t.done)
+
+    for {
+        err := t.CreateTemplate(t.client, t.path, plugin)
+        logError(t, err)
+        t.status.Done(t.Name, err, time.Now().Add(t.interval))
+
+        select {
+            case <-time.After(t.interval):
+            case <-t.sync:
+            case <-t.stop:
+                return
+        }
+    }
+}
+
+// logError logs the error of a template run, delayed applies are warnings.
+func logError(t *HTTPTemplate, err error) {
+    var delayed *delayedError
+    switch {
+        case err == nil:
+        case errors.As(err, &delayed):
+            log.Printf("[warn] %s: %v", t.Dest, err)
+        default:
+            log.Printf("[error] %v", err)
+    }
+}
+
+// statusHandler returns the handler of the status API.
+func statusHandler(reg *status.Registry) http.Handler {
+    mux := http.NewServeMux()
+
+    mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Write(encodeResp(&Resp{Status:"success", Data:reg.Templates()}))
+    })
+
+    mux.Handle("GET /metrics", promhttp.Handler())
+
+    mux.HandleFunc("POST /templates/{name}/sync", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        if !reg.Sync(r.PathValue("name")) {
+            w.WriteHeader(404)
+            w.Write(encodeResp(&Resp{Status:"error", Error:"template not found", Data:make([]int, 0)}))
+            return
+        }
+        w.WriteHeader(202)
+        w.Write(encodeResp(&Resp{Status:"success", Data:make([]int, 0)}))
+    })
+
+    return mux
+}
+
+// Agent runs the templates of the config file and applies its changes on reload.
+type Agent struct {
+    File             string
+    KeyFile          string
+    Decrypt          bool
+    Plugin           string
+    Noop             bool
+    Status           *status.Registry
+    lock             sync.Mutex
+    reloading        sync.Mutex
+    shared
+    running          map[string]*HTTPTemplate
+    hash             string
+    include          string
+}
+
+// shared are the objects of the global section used by all templates.
+type shared struct {
+    global           string
+    groups           map[string]*command.Debouncer
+    cache            *cache.Cache
+    changes          *changes.Reporter
+}
+
+func NewAgent(file, keyFile string, dcrpt bool, plugin string, noop bool) *Agent {
+    return &Agent{
+        File:    file,
+        KeyFile: keyFile,
+        Decrypt: dcrpt,
+        Plugin:  plugin,
+        Noop:    noop,
+        Status:  status.NewRegistry(),
+        running: map[string]*HTTPTemplate{},
+    }
+}
+
+func sortedURLs(urls []string) []string {
+    sorted := append([]string{}, urls...)
+    sort.Strings(sorted)
+    return sorted
+}
+
+// fingerprint returns the JSON of the global settings or the template
+// with the URLs sorted, they are shuffled on every load.
+func fingerprint(v interface{}) string {
+    switch c := v.(type) {
+        case *Global:
+            g := *c
+            g.URLs = sortedURLs(g.URLs)
+            v = g
+        case *HTTPTemplate:
+            t := *c
+            t.URLs = sortedURLs(t.URLs)
+            t.Sources = map[string]*Source{}
+            for name, src := range c.Sources {
+                sc := *src
+                sc.URLs = sortedURLs(sc.URLs)
+                t.Sources[name] = &sc
+            }
+            v = t
+    }
+    data, _ := json.Marshal(v)
+    return string(data)
+}
+
+// Load reads the config file and prepares its templates,
+// templates without URLs are skipped with a warning.
+func (a *Agent) Load() ([]*HTTPTemplate, error) {
+    cfg, err := loadConfigFile(a.File, a.KeyFile, a.Decrypt)
+    if err != nil {
+        return nil, err
+    }
+
+    hash, err := a.contentHash(cfg.Global.Include)
+    if err != nil {
+        return nil, err
+    }
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    // Состояние агента меняется только после подготовки всех шаблонов
+    sh := a.shared
+
+    // Общие объекты пересоздаются только при изменении global
+    global := fingerprint(cfg.Global)
+    if global != sh.global {
+        groups := map[string]*command.Debouncer{}
+        for name, g := range cfg.Global.ReloadGroups {
+            group, err := newGroup(name, g, cfg.Global.ReloadDebounce)
+            if err != nil {
+                return nil, err
+            }
+            groups[name] = group
+        }
+
+        // В режиме noop каталоги не создаются: кэш только читается, история не ведется
+        var respCache *cache.Cache
+        if cfg.Global.CacheDir != "" {
+            if a.Noop {
+                respCache = &cache.Cache{ Dir: cfg.Global.CacheDir }
+            } else if respCache, err = cache.New(cfg.Global.CacheDir); err != nil {
+                return nil, fmt.Errorf("creating cache directory: %v", err)
+            }
+        }
+
+        historyDir := cfg.Global.HistoryDir
+        if a.Noop {
+            historyDir = ""
+        }
+
+        reporter, err := changes.New(changes.Config{
+            Redact:      cfg.Global.Redact,
+            HistoryDir:  historyDir,
+            HistorySize: cfg.Global.HistorySize,
+            URL:         cfg.Global.ChangeURL,
+        })
+        if err != nil {
+            return nil, err
+        }
+
+        sh = shared{ global: global, groups: groups, cache: respCache, changes: reporter }
+    }
+
+    var templates []*HTTPTemplate
+    names := map[string]bool{}
+    bad := map[string]bool{}
+
+    for _, tl := range cfg.Templates {
+        if bad[tl.file] {
+            continue
+        }
+
+        ok, err := a.prepare(tl, cfg.Global, &sh, names)
+        if err != nil {
+            if tl.file == "" {
+                return nil, err
+            }
+            log.Printf("[error] %s: %v, its templates are disabled", tl.file, err)
+            bad[tl.file] = true
+            continue
+        }
+        if !ok {
+            log.Printf("[warn] template %s: no urls or sources, it is skipped", tl.Dest)
+            continue
+        }
+        templates = append(templates, tl)
+    }
+
+    // Шаблоны файла с ошибкой отключаются целиком
+    enabled := templates[:0]
+    for _, tl := range templates {
+        if !bad[tl.file] {
+            enabled = append(enabled, tl)
+        }
+    }
+
+    a.shared, a.hash, a.include = sh, hash, cfg.Global.Include
+
+    return enabled, nil
+}
+
+// prepare sets the defaults of the template, false if it has no URLs.
+func (a *Agent) prepare(tl *HTTPTemplate, g *Global, sh *shared, names map[string]bool) (bool, error) {
+
+    // Set name
+    if tl.Name == "" {
+        tl.Name = filepath.Base(tl.target())
+        for i := 2; names[tl.Name]; i++ {
+            tl.Name = fmt.Sprintf("%s-%d", filepath.Base(tl.target()), i)
+        }
+    }
+    if names[tl.Name] {
+        return false, fmt.Errorf("template name %s is not unique", tl.Name)
+    }
+    names[tl.Name] = true
+
+    // Set reload group
+    if tl.ReloadGroup != "" {
+        group, ok := sh.groups[tl.ReloadGroup]
+        if !ok {
+            return false, fmt.Errorf("template %s: unknown reload group %s", tl.Dest, tl.ReloadGroup)
+        }
+        if tl.ReloadCmd != "" || len(tl.ReloadArgs) > 0 {
+            log.Printf("[warn] template %s: reload_cmd is ignored, reload group %s is used", tl.Dest, tl.ReloadGroup)
+        }
+        tl.group = group
+    }
+
+    // Set default URLs
+    if len(tl.URLs) == 0 {
+        for _, u := range g.URLs {
+            tl.URLs = append(tl.URLs, u)
+        }
+    }
+    if len(tl.URLs) == 0 && len(tl.Sources) == 0 {
+        return false, nil
+    }
+
+    // Set default ContentEncoding
+    if tl.ContentEncoding == "" {
+        tl.ContentEncoding = g.ContentEncoding
+    }
+
+    // Set Interval
+    if tl.Interval == "" {
+        tl.Interval = "30s"
+    }
+    tl.interval, _ = time.ParseDuration(tl.Interval)
+    if tl.interval == 0 {
+        return false, fmt.Errorf("template %s: setting interval: invalid duration", tl.Dest)
+    }
+
+    // Set Timeout
+    if tl.Timeout == "" {
+        tl.Timeout = "5s"
+    }
+    tlTimeout, _ := time.ParseDuration(tl.Timeout)
+    if tlTimeout == 0 {
+        return false, fmt.Errorf("template %s: setting timeout: invalid duration", tl.Dest)
+    }
+
+    path, err := template.New(tl.Path).Execute(tl.Path, nil)
+    if err != nil {
+        return false, fmt.Errorf("template %s: %v", tl.Dest, err)
+    }
+
+    // Set sources
+    for name, src := range tl.Sources {
+        if len(src.URLs) == 0 {
+            src.URLs = tl.URLs
+        }
+        if len(src.URLs) == 0 {
+            return false, fmt.Errorf("template %s: source %s: no urls", tl.Dest, name)
+        }
+        if src.Username == "" {
+            src.Username, src.Password = tl.Username, tl.Password
+        }
+        if src.ContentEncoding == "" {
+            src.ContentEncoding = tl.ContentEncoding
+        }
+        if src.Timeout == "" {
+            src.Timeout = tl.Timeout
+        }
+        timeout, _ := time.ParseDuration(src.Timeout)
+        if timeout == 0 {
+            return false, fmt.Errorf("template %s: source %s: setting timeout: invalid duration", tl.Dest, name)
+        }
+
+        path, err := template.New(src.Path).Execute(src.Path, nil)
+        if err != nil {
+            return false, fmt.Errorf("template %s: source %s: %v", tl.Dest, name, err)
+        }
+        src.path = string(path)
+        src.client = client.NewHttpClient(timeout)
+    }
+
+    // Check merge
+    for _, name := range tl.Merge {
+        if _, ok := tl.Sources[name]; !ok {
+            return false, fmt.Errorf("template %s: merge: unknown source %s", tl.Dest, name)
+        }
+    }
+    if err := (merge.Options{ Arrays: tl.MergeArrays, Rules: tl.MergeRules }).Validate(); err != nil {
+        return false, fmt.Errorf("template %s: merge: %v", tl.Dest, err)
+    }
+
+    // Set functions policy
+    if tl.Functions == nil {
+        tl.Functions = g.Functions
+    }
+    policy, err := tl.Functions.policy()
+    if err != nil {
+        return false, fmt.Errorf("template %s: functions: %v", tl.Dest, err)
+    }
+    tl.policy = policy
+
+    // Без политики функции окружения отключены, шаблоны с ними не отрисуются
+    if tl.Functions == nil && tl.Src != "" {
+        match := tl.SrcMatch
+        if match == "" {
+            match = tl.Src
+        }
+        problems, _ := template.Lint(tl.Src, match, nil)
+        for _, p := range problems {
+            if strings.Contains(p, "is not enabled by the template policy") {
+                log.Printf("[warn] template %s: %s, set groups of [global.functions] or [templates.functions]", tl.Dest, p)
+            }
+        }
+    }
+
+    // Check temp
+    if tl.Temp != "" && filepath.Dir(filepath.Clean(tl.Temp)) != filepath.Dir(filepath.Clean(tl.Dest)) {
+        log.Printf("[warn] template %s: temp %s is not in the directory of dest, a temporary file next to dest is used", tl.Dest, tl.Temp)
+        tl.Temp = ""
+    }
+
+    // Команда проверки выполняется до установки, dest еще содержит старую версию
+    if (tl.CheckCmd != "" || len(tl.CheckArgs) > 0) && !usesSrc(tl.CheckCmd, tl.CheckArgs) {
+        log.Printf("[warn] template %s: check command does not use {{.src}} or CONFD_SRC, it does not check the rendered file", tl.Dest)
+    }
+
+    // Check format
+    if tl.Format != "" && !format.Formats[tl.Format] {
+        return false, fmt.Errorf("template %s: unknown format %q", tl.Dest, tl.Format)
+    }
+
+    // Check rendered
+    if tl.Rendered {
+        if tl.Each != "" || len(tl.Sources) > 0 {
+            return false, fmt.Errorf("template %s: rendered cannot be used with each or sources", tl.Dest)
+        }
+        for _, c := range tl.Checks {
+            if c.Key != "" {
+                return false, fmt.Errorf("template %s: checks on keys are not supported by rendered templates", tl.Dest)
+            }
+        }
+    }
+
+    tl.spec = sh.global + fingerprint(tl)
+
+    tl.path = string(path)
+    tl.client = client.NewHttpClient(tlTimeout)
+    tl.status = a.Status
+    tl.cache = sh.cache
+    tl.noop = a.Noop
+    tl.changes = sh.changes
+
+    return true, nil
+}
+
+// Apply stops removed and changed templates and starts new and changed ones,
+// unchanged templates keep running with their hashes. Changed templates
+// start after their previous versions stopped, which is waited for
+// without holding the lock.
+func (a *Agent) Apply(templates []*HTTPTemplate) {
+    next := map[string]*HTTPTemplate{}
+    for _, t := range templates {
+        next[t.Name] = t
+    }
+    restarted := map[string]bool{}
+    var stopped []*HTTPTemplate
+
+    a.lock.Lock()
+    for name, t := range a.running {
+        if n, ok := next[name]; ok && n.spec == t.spec {
+            continue
+        }
+        close(t.stop)
+        stopped = append(stopped, t)
+        delete(a.running, name)
+        if _, ok := next[name]; ok {
+            restarted[name] = true
+        } else {
+            log.Printf("[info] template %s stopped", name)
+        }
+    }
+    a.lock.Unlock()
+
+    // Текущий запуск шаблона может занять время (reload_cmd, повторы)
+    for _, t := range stopped {
+        <-t.done
+        a.Status.Remove(t.Name)
+    }
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    for name, t := range next {
+        if _, ok := a.running[name]; ok {
+            continue
+        }
+
+        t.sync = make(chan struct{}, 1)
+        t.stop = make(chan struct{})
+        t.done = make(chan struct{})
+
+        a.Status.Add(status.Template{ Name: t.Name, Src: t.Src, Dest: t.Dest, Path: t.path }, func(t *HTTPTemplate) func() {
+            return func() {
+                select {
+                    case t.sync <- struct{}{}:
+                    default:
+                }
+            }
+        }(t))
+
+        a.running[name] = t
+        go t.run(a.Plugin)
+        if restarted[name] {
+            log.Printf("[info] template %s restarted", name)
+        } else {
+            log.Printf("[info] template %s started", name)
+        }
+    }
+}
+
+// Reload applies the config file, the running templates are kept if it is invalid.
+// Reloads by SIGHUP and by the config watch are made one at a time.
+func (a *Agent) Reload() error {
+    a.reloading.Lock()
+    defer a.reloading.Unlock()
+
+    templates, err := a.Load()
     if err != nil {
-        return "", err
+        return err
     }
-    plainText := []byte(text)
-    bytes := []byte{35, 46, 57, 24, 85, 35, 24, 74, 87, 35, 88, 98, 66, 32, 14, 05}
-    cfb := cipher.NewCFBEncrypter(block, bytes)
-    cipherText := make([]byte, len(plainText))
-    cfb.XORKeyStream(cipherText, plainText)
-    return base64.StdEncoding.EncodeToString(cipherText), nil
+    a.Apply(templates)
+    return nil
 }
- 
-func decrypt(text string) (string, error) {
-    block, err := aes.NewCipher([]byte(KeyString))
+
+// contentHash returns the hash of the config file and the included files.
+func (a *Agent) contentHash(include string) (string, error) {
+    content, err := ioutil.ReadFile(a.File)
     if err != nil {
         return "", err
     }
-    cipherText, err := base64.StdEncoding.DecodeString(text)
+
+    files, err := includeFiles(a.File, include)
     if err != nil {
         return "", err
     }
-    bytes := []byte{35, 46, 57, 24, 85, 35, 24, 74, 87, 35, 88, 98, 66, 32, 14, 05}
-    cfb := cipher.NewCFBDecrypter(block, bytes)
-    plainText := make([]byte, len(cipherText))
-    cfb.XORKeyStream(plainText, cipherText)
-    return string(plainText), nil
-}
-
-func encodeResp(resp *Resp) []byte {
-    jsn, err := json.Marshal(resp)
-    if err != nil {
-        return encodeResp(&Resp{Status:"error", Error:err.Error(), Data:make([]int, 0)})
+    for _, name := range files {
+        data, err := ioutil.ReadFile(name)
+        if err != nil {
+            continue
+        }
+        content = append(content, name+"\n"...)
+        content = append(content, data...)
     }
-    return jsn
-}
 
-func randURLs(urls []string) []string {
-    rand.Seed(time.Now().UnixNano())
-    rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
-    return urls
+    return config.GetHash(content), nil
 }
 
-func (t *HTTPTemplate) CreateConf(jsn interface{}) (int, error) {
-
-    if t.SrcMatch == "" {
-        t.SrcMatch = t.Src
-    }
+// Watch reloads the config file when its content or included files change.
+func (a *Agent) Watch(interval time.Duration) {
+    for {
+        time.Sleep(interval)
 
-    cont, err := template.New(t.Src).ParseGlob(t.SrcMatch, jsn)
-    if err != nil {
-        return 3, fmt.Errorf("generating config: %v", err)
-    }
+        a.lock.Lock()
+        include := a.include
+        a.lock.Unlock()
 
-    if _, err := os.Stat(t.Dest); err == nil {
-        conf, err := ioutil.ReadFile(t.Dest)
+        hash, err := a.contentHash(include)
         if err != nil {
-            return 4, fmt.Errorf("reading config file %s: %v", t.Dest, err)
+            log.Printf("[error] watching config file: %v", err)
+            continue
         }
-        if config.GetHash(conf) != config.GetHash(cont) {
-            if err := ioutil.WriteFile(t.Temp, cont, 0644); err != nil {
-                return 4, fmt.Errorf("writing config file %s: %v", t.Dest, err)
-            }
-            return 1, nil
+
+        a.lock.Lock()
+        changed := hash != a.hash
+        a.lock.Unlock()
+
+        if !changed {
+            continue
         }
-    } else if os.IsNotExist(err) {
-        if err := ioutil.WriteFile(t.Temp, cont, 0644); err != nil {
-            return 4, fmt.Errorf("writing config file %s: %v", t.Dest, err)
+
+        if err := a.Reload(); err != nil {
+            log.Printf("[error] reloading config file: %v", err)
+            // Повторно не перечитываем до следующего изменения
+            a.lock.Lock()
+            a.hash = hash
+            a.lock.Unlock()
+            continue
         }
-        return 1, nil
-    } else {
-        return 4, fmt.Errorf("reading config file status %s: %v", t.Dest, err)
+        log.Print("[info] config file reloaded")
     }
-
-    return 0, nil
 }
 
-func (t *HTTPTemplate) CreateTemplate(httpClient *client.HttpClient, path, plugin string) error {
-    if t.Temp == "" {
-        t.Temp = t.Dest
+// Once applies the templates once and returns the number of failed ones.
+func (a *Agent) Once(templates []*HTTPTemplate) int {
+    var wg sync.WaitGroup
+    var failed atomic.Int32
+
+    for _, t := range templates {
+        wg.Add(1)
+        go func(t *HTTPTemplate) {
+            defer wg.Done()
+            if err := t.CreateTemplate(t.client, t.path, a.Plugin); err != nil {
+                logError(t, err)
+                failed.Add(1)
+            }
+        }(t)
     }
 
-    httpConfig := client.HttpConfig{
-        URLs: t.URLs,
-        ContentEncoding: t.ContentEncoding,
-        Username: t.Username,
-        Password: t.Password,
-    }
+    wg.Wait()
+    a.changes.Wait()
 
-    resp, err := httpClient.NewRequest("GET", path, t.Hash, nil, httpConfig)
+    return int(failed.Load())
+}
+
+// decodeFile reads the TOML file into the config.
+func decodeFile(file string, cfg *Config) error {
+    f, err := os.Open(file)
     if err != nil {
         return err
     }
+    defer f.Close()
 
-    if resp.StatusCode == 204 {
-        return nil
-    }
+    return toml.NewDecoder(f).Decode(cfg)
+}
 
-    if resp.StatusCode == 404 {
-        if t.Create {
-            // parse url path
-            u, err := url.Parse(path)
-            if err != nil {
-                return err
-            }
+// includeFiles returns the template files matched by the include pattern,
+// a directory means its *.toml files. Relative patterns are taken from
+// the directory of the config file.
+func includeFiles(file, pattern string) ([]string, error) {
+    if pattern == "" {
+        return nil, nil
+    }
+    pattern = relativeTo(file, pattern)
+    if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+        pattern = filepath.Join(pattern, "*.toml")
+    }
+    return filepath.Glob(pattern)
+}
 
-            httpClient.NewRequest("PUT", u.Path, "", []byte("dir=true"), httpConfig)
-        }
-        return nil
+// relativeTo returns the name taken from the directory of the config file if it is relative.
+func relativeTo(file, name string) string {
+    if filepath.IsAbs(name) {
+        return name
     }
+    return filepath.Join(filepath.Dir(file), name)
+}
 
-    if resp.StatusCode == 403 {
-        err := fmt.Errorf("when request to [%s] received status code: 403", path)
-        return err
+// loading configuration file
+func loadConfigFile(file, keyFile string, dcrpt bool) (Config, error) {
+    var cfg Config
+
+    if err := decodeFile(file, &cfg); err != nil {
+        return cfg, err
     }
 
-    if resp.StatusCode != 200 {
-        return nil
+    if cfg.Global == nil {
+        cfg.Global = &Global{}
     }
 
-    if t.Modified {
-        t.Hash = config.GetHash(resp.Body)
+    cfg.Global.URLs = randURLs(cfg.Global.URLs)
+
+    // Checks for all templates
+    if cfg.Global.ChecksFile != "" {
+        var checks Checks
+        checksFile := relativeTo(file, cfg.Global.ChecksFile)
+        cf, err := os.Open(checksFile)
+        if err != nil {
+            return cfg, err
+        }
+        defer cf.Close()
+        if err := toml.NewDecoder(cf).Decode(&checks); err != nil {
+            return cfg, fmt.Errorf("%s: %v", checksFile, err)
+        }
+        cfg.Global.checks = checks.Checks
     }
 
-    var jsn interface{}
-    if err := json.Unmarshal(resp.Body, &jsn); err != nil {
-        if plugin == "telegraf" || plugin == "windows" {    
-            fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, 1)
+    var key *secret.Key
+    if dcrpt {
+        var err error
+        key, err = readKey(keyFile, file, cfg.Global.PKey)
+        if err != nil {
+            return cfg, err
         }
-        return err
     }
 
-    succ, err := t.CreateConf(jsn)
+    if err := setupTemplates(cfg.Templates, cfg.Global, key, dcrpt); err != nil {
+        return cfg, err
+    }
+
+    // Template files of the include directory, a broken file
+    // disables only its own templates
+    files, err := includeFiles(file, cfg.Global.Include)
     if err != nil {
-        if plugin == "telegraf" || plugin == "windows" {    
-            fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, succ)
+        return cfg, fmt.Errorf("include: %v", err)
+    }
+    for _, name := range files {
+        var inc Config
+        err := decodeFile(name, &inc)
+        if err == nil {
+            err = setupTemplates(inc.Templates, cfg.Global, key, dcrpt)
         }
-        return err
+        if err != nil {
+            log.Printf("[error] %s: %v, its templates are disabled", name, err)
+            continue
+        }
+        if inc.Global != nil {
+            log.Printf("[warn] %s: global is only read from %s", name, file)
+        }
+        for _, tmpl := range inc.Templates {
+            tmpl.file = name
+        }
+        cfg.Templates = append(cfg.Templates, inc.Templates...)
     }
 
-    if succ == 1 {
-        if t.CheckCmd != "" {
-            _, err := runCommand(t.CheckCmd, 10)
-            if err != nil {
-                if plugin == "telegraf" || plugin == "windows" {
-                    fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, 3)
-                }
-                return err
-            } 
-        }
+    return cfg, nil
+}
 
-        if t.Temp != t.Dest {
-            err := os.Rename(t.Temp, t.Dest)
-            if err != nil {
-                if plugin == "telegraf" || plugin == "windows" {
-                    fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, 3)
-                }
-                return err
+// setupTemplates shuffles the URLs, adds global checks and decrypts passwords.
+func setupTemplates(templates []*HTTPTemplate, global *Global, key *secret.Key, dcrpt bool) error {
+    for _, tmpl := range templates {
+        tmpl.URLs = randURLs(tmpl.URLs)
+        tmpl.Checks = append(append([]Check{}, global.checks...), tmpl.Checks...)
+
+        for _, c := range tmpl.Checks {
+            if c.Timeout == "" {
+                continue
+            }
+            if _, err := time.ParseDuration(c.Timeout); err != nil {
+                return fmt.Errorf("check timeout for %s: %v", tmpl.Dest, err)
             }
         }
 
-        if plugin == "telegraf" || plugin == "windows" {
-            fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, 1)
+        if dcrpt && tmpl.Password != "" {
+            if !strings.HasPrefix(tmpl.Password, cipherPrefix) {
+                log.Printf("[warn] password for %s uses the legacy format, run cdagent -rotate-key", tmpl.Dest)
+            }
+            passwd, err := decrypt(key, tmpl.Password)
+            if err != nil {
+                return fmt.Errorf("decrypting password for %s: %v", tmpl.Dest, err)
+            }
+            tmpl.Password = passwd
         }
 
-        if t.ReloadCmd != "" {
-            runCommand(t.ReloadCmd, 10)
+        for name, src := range tmpl.Sources {
+            src.URLs = randURLs(src.URLs)
+            if dcrpt && src.Password != "" {
+                passwd, err := decrypt(key, src.Password)
+                if err != nil {
+                    return fmt.Errorf("decrypting password for %s source %s: %v", tmpl.Dest, name, err)
+                }
+                src.Password = passwd
+            }
         }
-
-        return nil
-    }
-
-    if plugin == "telegraf" || plugin == "windows" {
-        fmt.Printf("confd,src=%s,dest=%s success=%d\n", t.Src, t.Dest, 0)
     }
 
     return nil
 }
 
-func runCommand(scmd string, timeout time.Duration) ([]byte, error) {
-    log.Printf("[info] running '%s'", scmd)
-    // Create a new context and add a timeout to it
-    ctx, cancel := context.WithTimeout(context.Background(), timeout * time.Second)
-    defer cancel() // The cancel should be deferred so resources are cleaned up
-
-    // Create the command with our context
-    var cmd *exec.Cmd
-    if runtime.GOOS == "windows" {
-        cmd = exec.CommandContext(ctx, "cmd", "/C", scmd)
-    } else {
-        cmd = exec.CommandContext(ctx, "/bin/sh", "-c", scmd)
-    }
-
-    // This time we can simply use Output() to get the result.
-    out, err := cmd.Output()
-
-    // Check the context error to see if the timeout was executed
-    if ctx.Err() == context.DeadlineExceeded {
-        return nil, fmt.Errorf("command timed out '%s'", scmd)
+// runTests renders the template with every DIR/<case>.json and compares
+// the result with DIR/<case>.out using the functions policy, with update
+// the .out files are written. It returns the number of failed cases.
+func runTests(dir, tmpl, match string, update bool, policy *template.Policy) (int, error) {
+    if match == "" {
+        match = tmpl
     }
 
-    // If there's no context error, we know the command completed (or errored).
+    problems, err := template.Lint(tmpl, match, policy)
     if err != nil {
-        return nil, fmt.Errorf("non-zero exit code: %v '%s'", err, scmd)
+        return 0, err
+    }
+    for _, p := range problems {
+        fmt.Println(p)
+    }
+    if len(problems) > 0 {
+        return 1, nil
     }
 
-    log.Printf("[info] finished '%s'", scmd)
-    return out, nil
-}
-
-// loading configuration file
-func loadConfigFile(file string, dcrpt bool) (Config, error) {
-    var cfg Config
-
-    f, err := os.Open(file)
+    cases, err := filepath.Glob(filepath.Join(dir, "*.json"))
     if err != nil {
-        return cfg, err
+        return 0, err
     }
-    
-    if err := toml.NewDecoder(f).Decode(&cfg); err != nil {
-        return cfg, err
+    if len(cases) == 0 {
+        return 0, fmt.Errorf("no test cases in %s", dir)
     }
+    sort.Strings(cases)
 
-    f.Close()
+    failed := 0
+    for _, input := range cases {
+        name := strings.TrimSuffix(filepath.Base(input), ".json")
+        golden := strings.TrimSuffix(input, ".json") + ".out"
 
-    cfg.Global.URLs = randURLs(cfg.Global.URLs)
+        fail := func(format string, args ...interface{}) {
+            fmt.Printf("FAIL %s: %s\n", name, fmt.Sprintf(format, args...))
+            failed++
+        }
+
+        data, err := ioutil.ReadFile(input)
+        if err != nil {
+            return failed, err
+        }
+        var jsn interface{}
+        if err := json.Unmarshal(data, &jsn); err != nil {
+            fail("parsing json file: %v", err)
+            continue
+        }
 
-    for i, tmpl := range cfg.Templates {
-        cfg.Templates[i].URLs = randURLs(tmpl.URLs)
+        cont, err := template.New(tmpl).WithPolicy(policy).ParseGlob(match, jsn)
+        if err != nil {
+            fail("%v", err)
+            continue
+        }
+        if lines := template.MissingKeys(cont); len(lines) > 0 {
+            fail("<no value> on lines %v, key is missing in data", lines)
+            continue
+        }
 
-        if dcrpt && tmpl.Password != "" {
-            passwd, err := decrypt(tmpl.Password)
-            if err != nil {
-                log.Fatalf("[error] %v", err)
+        if update {
+            if err := ioutil.WriteFile(golden, cont, 0644); err != nil {
+                return failed, err
             }
-            cfg.Templates[i].Password = passwd
+            fmt.Printf("ok   %s (updated)\n", name)
+            continue
+        }
+
+        expected, err := ioutil.ReadFile(golden)
+        if err != nil {
+            fail("%v", err)
+            continue
+        }
+        d, err := diff.Unified(golden, "rendered", expected, cont)
+        if err != nil {
+            return failed, err
+        }
+        if d != "" {
+            fail("output differs\n%s", d)
+            continue
         }
+        fmt.Printf("ok   %s\n", name)
     }
 
-    return cfg, nil
+    fmt.Printf("%d passed, %d failed\n", len(cases) - failed, failed)
+
+    return failed, nil
 }
 
 func main() {
@@ -346,11 +2247,24 @@ func main() {
     version         := flag.Bool("version", false, "show cdagent version")
     encryptPass     := flag.String("encrypt", "", "encrypt string")
     decryptPass     := flag.Bool("decrypt", false, "decrypt password string")
+    keyFile         := flag.String("key.file", "", "key file (default global pkey or $CDAGENT_KEY)")
+    oldKeyFile      := flag.String("old-key.file", "", "previous key file for -rotate-key")
+    keyGenerate     := flag.String("key.generate", "", "write a new random key to the file and exit")
+    rotate          := flag.Bool("rotate-key", false, "re-encrypt passwords in the config file with the key and exit")
+
+    lsAddress       := flag.String("web.listen-address", "", "listen address of the status API, disabled by default")
+    onetime         := flag.Bool("onetime", false, "apply all templates once and exit, the exit status is 1 if any failed")
+    noop            := flag.Bool("noop", false, "print the diffs of all templates once and exit without changing anything")
+    watchConfig     := flag.Bool("watch-config", false, "reload the config file when it changes")
+    watchInterval   := flag.Duration("watch-config.interval", 5 * time.Second, "interval of config file change checks")
 
     srcFile         := flag.String("src-file", "", "source file")
     srcTmpl         := flag.String("src-tmpl", "", "source template")
     srcMatch        := flag.String("src-match", "", "source match")
     destFile        := flag.String("dest-file", "", "destination file")
+    lint            := flag.Bool("lint", false, "check the templates of the config file and exit, the exit status is 1 if problems are found")
+    testDir         := flag.String("test", "", "render -src-tmpl with every <case>.json of the directory, compare with <case>.out and exit")
+    testUpdate      := flag.Bool("test.update", false, "write the <case>.out files of -test instead of comparing")
 
     flag.Parse()
 
@@ -360,9 +2274,44 @@ func main() {
         return
     }
 
+    // Generate key
+    if *keyGenerate != "" {
+        passphrase, err := secret.GenerateKey()
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        f, err := os.OpenFile(*keyGenerate, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        if _, err := f.WriteString(passphrase + "\n"); err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        if err := f.Close(); err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        return
+    }
+
+    // Global pkey is used when no key file is given
+    pkey := ""
+    if *keyFile == "" && (*encryptPass != "" || *rotate) {
+        var cfg Config
+        if f, err := os.Open(*cfFile); err == nil {
+            if err := toml.NewDecoder(f).Decode(&cfg); err == nil && cfg.Global != nil {
+                pkey = cfg.Global.PKey
+            }
+            f.Close()
+        }
+    }
+
     // Encrypt
     if *encryptPass != "" {
-        passwd, err := encrypt(*encryptPass)
+        key, err := readKey(*keyFile, *cfFile, pkey)
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        passwd, err := encrypt(key, *encryptPass)
         if err != nil {
             log.Fatalf("[error] %v", err)
         }
@@ -370,6 +2319,56 @@ func main() {
         return
     }
 
+    // Re-encrypt passwords
+    if *rotate {
+        newKey, err := readKey(*keyFile, *cfFile, pkey)
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        oldKey := newKey
+        if *oldKeyFile != "" {
+            if oldKey, err = secret.ReadKey(*oldKeyFile, ""); err != nil {
+                log.Fatalf("[error] %v", err)
+            }
+        }
+        files := []string{*cfFile}
+        var cfg Config
+        if err := decodeFile(*cfFile, &cfg); err == nil && cfg.Global != nil {
+            include, err := includeFiles(*cfFile, cfg.Global.Include)
+            if err != nil {
+                log.Fatalf("[error] include: %v", err)
+            }
+            files = append(files, include...)
+        }
+        for _, file := range files {
+            count, err := rotateKey(file, oldKey, newKey)
+            if err != nil {
+                log.Fatalf("[error] rotating key in %s: %v", file, err)
+            }
+            log.Printf("[info] %d passwords re-encrypted in %s", count, file)
+        }
+        return
+    }
+
+    // Test templates
+    if *testDir != "" {
+        if *srcTmpl == "" {
+            log.Fatalf("[error] -test requires -src-tmpl")
+        }
+        policy, err := srcPolicy(*cfFile, *srcTmpl)
+        if err != nil {
+            log.Fatalf("[error] reading functions policy of %s: %v", *cfFile, err)
+        }
+        failed, err := runTests(*testDir, *srcTmpl, *srcMatch, *testUpdate, policy)
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        if failed > 0 {
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+
     // Generate configuration
     if *srcFile != "" {
         data, err := ioutil.ReadFile(*srcFile)
@@ -386,12 +2385,27 @@ func main() {
             srcMatch = srcTmpl
         }
 
-        cont, err := template.New(*srcTmpl).ParseGlob(*srcMatch, jsn)
+        // Политика функций берется из шаблона с тем же src или global файла конфигурации
+        policy, err := srcPolicy(*cfFile, *srcTmpl)
+        if err != nil {
+            log.Fatalf("[error] reading functions policy of %s: %v", *cfFile, err)
+        }
+
+        cont, err := template.New(*srcTmpl).WithPolicy(policy).ParseGlob(*srcMatch, jsn)
         if err != nil {
             log.Fatalf("[error] generating config file: %v", err)
         }
 
-        if err := ioutil.WriteFile(*destFile, cont, 0644); err != nil {
+        attrs, err := file.GetAttrs(*destFile, file.Options{})
+        if err != nil {
+            log.Fatalf("[error] writing config file: %v", err)
+        }
+        temp, err := file.WriteTemp(*destFile, "", cont, attrs)
+        if err != nil {
+            log.Fatalf("[error] writing config file: %v", err)
+        }
+        if err := file.Install(temp, *destFile); err != nil {
+            os.Remove(temp)
             log.Fatalf("[error] writing config file: %v", err)
         }
 
@@ -410,24 +2424,60 @@ func main() {
     }
 
     // loading configuration file
-    cfg, err := loadConfigFile(*cfFile, *decryptPass)
+    agent := NewAgent(*cfFile, *keyFile, *decryptPass, *plugin, *noop)
+    templates, err := agent.Load()
     if err != nil {
         log.Fatalf("[error] reading config file: %v", err)
     }
 
+    // Check templates
+    if *lint {
+        count := 0
+        for _, t := range templates {
+            for _, p := range t.lint() {
+                fmt.Println(p)
+                count++
+            }
+        }
+        if count > 0 {
+            log.Printf("[error] %d problems found in %d templates", count, len(templates))
+            os.Exit(1)
+        }
+        log.Printf("[info] %d templates checked, no problems found", len(templates))
+        os.Exit(0)
+    }
+
     log.Print("[info] cdagent started -_-")
 
+    // Oneshot and noop modes
+    if *onetime || *noop {
+        if n := agent.Once(templates); n > 0 {
+            log.Printf("[error] %d of %d templates failed", n, len(templates))
+            os.Exit(1)
+        }
+        return
+    }
+
     run := true
 
     // Program signal processing
     c := make(chan os.Signal, 1)
     signal.Notify(c, os.Interrupt, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+    // Шаблоны запускаются до обработки сигналов, SIGHUP ждет в канале
+    agent.Apply(templates)
+
     go func(){
         for {
             s := <-c
             switch s {
                 case syscall.SIGHUP:
                     run = true
+                    if err := agent.Reload(); err != nil {
+                        log.Printf("[error] reloading config file: %v", err)
+                        continue
+                    }
+                    log.Print("[info] config file reloaded")
                 case syscall.SIGINT:
                     log.Print("[info] cdagent stopped")
                     os.Exit(0)
@@ -440,57 +2490,17 @@ func main() {
         }
     }()
 
-    for _, tl := range cfg.Templates {
-
-        // Set default URLs
-        if len(tl.URLs) == 0 {
-            for _, u := range cfg.Global.URLs {
-                tl.URLs = append(tl.URLs, u)
-            }
-        }
-        if len(tl.URLs) == 0 {
-            continue
-        }
-
-        // Set default ContentEncoding
-        if tl.ContentEncoding == "" {
-            tl.ContentEncoding = cfg.Global.ContentEncoding
-        }
-
-        // Set Interval
-        if tl.Interval == "" {
-            tl.Interval = "30s"
-        }
-        tlInterval, _ := time.ParseDuration(tl.Interval)
-        if tlInterval == 0 {
-            log.Fatal("[error] setting interval: invalid duration")
-        }
-
-        // Set Timeout
-        if tl.Timeout == "" {
-            tl.Timeout = "5s"
-        }
-        tlTimeout, _ := time.ParseDuration(tl.Timeout)
-        if tlTimeout == 0 {
-            log.Fatal("[error] setting timeout: invalid duration")
-        }
-
-        httpClient := client.NewHttpClient(tlTimeout)
-
-        path, err := template.New(tl.Path).Execute(tl.Path, nil)
-        if err != nil {
-            log.Printf("[error] %v", err)
-            continue
-        }
+    if *watchConfig {
+        go agent.Watch(*watchInterval)
+    }
 
-        go func(t *HTTPTemplate, path string) {
-            for {
-                if err := t.CreateTemplate(httpClient, path, *plugin); err != nil {
-                    log.Printf("[error] %v", err)
-                }
-                time.Sleep(tlInterval)
+    // Status API
+    if *lsAddress != "" {
+        go func() {
+            if err := http.ListenAndServe(*lsAddress, statusHandler(agent.Status)); err != nil {
+                log.Fatalf("[error] %v", err)
             }
-        }(tl, string(path))
+        }()
     }
 
     // Daemon mode
@@ -505,4 +2515,4 @@ func main() {
         time.Sleep(time.Duration(*interval) * time.Second)
     }
 
-}
\ No newline at end of file
+}
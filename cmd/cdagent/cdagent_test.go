@@ -0,0 +1,364 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "crypto/aes"
+    "crypto/cipher"
+    "encoding/base64"
+    "net/http"
+    "net/http/httptest"
+    "io/ioutil"
+    "path/filepath"
+    "github.com/ltkh/confd/internal/client"
+    "github.com/ltkh/confd/internal/secret"
+    "github.com/ltkh/confd/internal/template"
+)
+
+func TestRotateKey(t *testing.T) {
+    oldKey, _ := secret.NewKey([]byte("old"))
+    newKey, _ := secret.NewKey([]byte("new"))
+
+    basic, err := encrypt(oldKey, "secret1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    literal, err := encrypt(oldKey, "secret2")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    name := filepath.Join(t.TempDir(), "confd.toml")
+    content := "[global]\n" +
+        "[[templates]]\ndest = \"/tmp/a\"\npassword = \"" + basic + "\"\n" +
+        "[[templates]]\ndest = \"/tmp/b\"\npassword = '" + literal + "'\n"
+    if err := ioutil.WriteFile(name, []byte(content), 0640); err != nil {
+        t.Fatal(err)
+    }
+
+    count, err := rotateKey(name, oldKey, newKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 2 {
+        t.Errorf("rotateKey() = %d, want 2", count)
+    }
+
+    data, _ := ioutil.ReadFile(name)
+    if strings.Contains(string(data), basic) || strings.Contains(string(data), literal) {
+        t.Errorf("old values are left in the file:\n%s", data)
+    }
+
+    var cfg Config
+    if err := decodeFile(name, &cfg); err != nil {
+        t.Fatal(err)
+    }
+    for i, want := range []string{"secret1", "secret2"} {
+        got, err := decrypt(newKey, cfg.Templates[i].Password)
+        if err != nil || got != want {
+            t.Errorf("template %d: decrypt() = %q, %v, want %q", i, got, err, want)
+        }
+    }
+
+    if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0640 {
+        t.Errorf("mode of the file is not kept: %v, %v", info.Mode(), err)
+    }
+}
+
+// encryptLegacy writes a value the way passwords were encrypted before per-installation keys.
+func encryptLegacy(t *testing.T, text string) string {
+    block, err := aes.NewCipher([]byte(legacyKey))
+    if err != nil {
+        t.Fatal(err)
+    }
+    iv := []byte{35, 46, 57, 24, 85, 35, 24, 74, 87, 35, 88, 98, 66, 32, 14, 05}
+    out := make([]byte, len(text))
+    cipher.NewCFBEncrypter(block, iv).XORKeyStream(out, []byte(text))
+    return base64.StdEncoding.EncodeToString(out)
+}
+
+func TestRotateKeyPlain(t *testing.T) {
+    oldKey, _ := secret.NewKey([]byte("old"))
+    newKey, _ := secret.NewKey([]byte("new"))
+
+    legacy := encryptLegacy(t, "secret1")
+    if !isLegacy(legacy) {
+        t.Fatalf("isLegacy(%q) = false", legacy)
+    }
+
+    // "test" и "password" - корректный base64, но не зашифрованные значения
+    name := filepath.Join(t.TempDir(), "confd.toml")
+    content := "[global]\n" +
+        "[[templates]]\ndest = \"/tmp/a\"\npassword = \"" + legacy + "\"\n" +
+        "[[templates]]\ndest = \"/tmp/b\"\npassword = \"test\"\n" +
+        "[[templates]]\ndest = \"/tmp/c\"\npassword = \"password\"\n"
+    if err := ioutil.WriteFile(name, []byte(content), 0640); err != nil {
+        t.Fatal(err)
+    }
+
+    count, err := rotateKey(name, oldKey, newKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if count != 1 {
+        t.Errorf("rotateKey() = %d, want 1", count)
+    }
+
+    var cfg Config
+    if err := decodeFile(name, &cfg); err != nil {
+        t.Fatal(err)
+    }
+    if got, err := decrypt(newKey, cfg.Templates[0].Password); err != nil || got != "secret1" {
+        t.Errorf("legacy value: decrypt() = %q, %v, want secret1", got, err)
+    }
+    if cfg.Templates[1].Password != "test" || cfg.Templates[2].Password != "password" {
+        t.Errorf("plain passwords are changed: %q, %q", cfg.Templates[1].Password, cfg.Templates[2].Password)
+    }
+}
+
+func TestReadKeyRelative(t *testing.T) {
+    dir := t.TempDir()
+    key, err := secret.GenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    ioutil.WriteFile(filepath.Join(dir, "key"), []byte(key), 0600)
+
+    // pkey ищется рядом с конфигурацией, а не в текущем каталоге
+    if k, err := readKey("", filepath.Join(dir, "confd.toml"), "key"); err != nil || k == nil {
+        t.Errorf("readKey() = %v, %v", k, err)
+    }
+}
+
+func TestCreateTemplateStatus(t *testing.T) {
+    var puts []string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch {
+            case r.Method == "PUT":
+                puts = append(puts, r.URL.Path)
+            case r.URL.Path == "/missing":
+                w.WriteHeader(404)
+            default:
+                w.WriteHeader(500)
+        }
+    }))
+    defer srv.Close()
+
+    httpClient := client.NewHttpClient(5)
+
+    tests := []struct {
+        path   string
+        create bool
+        err    bool
+    }{
+        {"/missing", false, true},
+        {"/missing", true, false},
+        {"/broken", false, true},
+    }
+
+    for _, tt := range tests {
+        puts = nil
+        tl := &HTTPTemplate{ URLs: []string{srv.URL}, Dest: "/tmp/dest", Create: tt.create }
+        err := tl.CreateTemplate(httpClient, tt.path, "")
+        if (err != nil) != tt.err {
+            t.Errorf("CreateTemplate(%s, create %v) error = %v, want error %v", tt.path, tt.create, err, tt.err)
+        }
+        if tt.create && len(puts) != 1 {
+            t.Errorf("CreateTemplate(%s, create) made %d PUT requests, want 1", tt.path, len(puts))
+        }
+    }
+}
+
+func TestCheckEval(t *testing.T) {
+    jsn := map[string]interface{}{
+        "app": map[string]interface{}{"ready": true, "nodes": []interface{}{"n1"}},
+    }
+
+    tests := []struct {
+        check Check
+        pass  bool
+    }{
+        {Check{Key: "app.ready"}, true},
+        {Check{Key: "app.ready", Value: "true"}, true},
+        {Check{Key: "app.ready", Value: "false"}, false},
+        {Check{Key: "app.nodes.0", Value: "n1"}, true},
+        {Check{Key: "app.missing"}, false},
+        {Check{File: "/nonexistent"}, false},
+    }
+
+    for _, tt := range tests {
+        if err := tt.check.Eval(jsn); (err == nil) != tt.pass {
+            t.Errorf("%+v: Eval() = %v, want pass %v", tt.check, err, tt.pass)
+        }
+    }
+}
+
+func TestChecksFileRelative(t *testing.T) {
+    dir := t.TempDir()
+    name := filepath.Join(dir, "confd.toml")
+    ioutil.WriteFile(name, []byte("[global]\nchecks_file = \"checks.toml\"\n"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "checks.toml"), []byte("[[checks]]\nkey = \"ready\"\n"), 0644)
+
+    // Файл проверок ищется рядом с конфигурацией, а не в текущем каталоге
+    cfg, err := loadConfigFile(name, "", false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cfg.Global.checks) != 1 || cfg.Global.checks[0].Key != "ready" {
+        t.Errorf("checks = %+v", cfg.Global.checks)
+    }
+}
+
+func TestLintData(t *testing.T) {
+    dir := t.TempDir()
+    src := filepath.Join(dir, "app.tmpl")
+    ioutil.WriteFile(src, []byte("role = {{ .role }}\nzone = {{ .zone }}\n"), 0644)
+    sample := filepath.Join(dir, "sample.json")
+    ioutil.WriteFile(sample, []byte(`{"role": "web"}`), 0644)
+
+    // Без кэша и образца отсутствующие ключи не проверяются
+    tl := &HTTPTemplate{ Src: src, Dest: filepath.Join(dir, "app.conf") }
+    if problems := tl.lint(); len(problems) != 0 {
+        t.Errorf("lint() without data = %q", problems)
+    }
+
+    tl.LintData = sample
+    problems := tl.lint()
+    if len(problems) != 1 || !strings.Contains(problems[0], "app.conf:2: <no value>, key is missing in "+sample) {
+        t.Errorf("lint() with lint_data = %q", problems)
+    }
+
+    tl.LintData = filepath.Join(dir, "missing.json")
+    if problems := tl.lint(); len(problems) != 1 || !strings.Contains(problems[0], "lint_data") {
+        t.Errorf("lint() with missing lint_data = %q", problems)
+    }
+}
+
+func TestTempOutsideDest(t *testing.T) {
+    dir := t.TempDir()
+    tl := &HTTPTemplate{
+        URLs: []string{"http://127.0.0.1:1"},
+        Dest: filepath.Join(dir, "a.conf"),
+        Temp: filepath.Join(t.TempDir(), "a.conf.tmp"),
+    }
+
+    // Временный файл вне каталога dest заменяется файлом рядом с dest
+    a := NewAgent("", "", false, "", true)
+    if ok, err := a.prepare(tl, &Global{}, &shared{}, map[string]bool{}); !ok || err != nil {
+        t.Fatalf("prepare() = %v, %v", ok, err)
+    }
+    if tl.Temp != "" {
+        t.Errorf("temp = %q, want a temporary file next to dest", tl.Temp)
+    }
+}
+
+func TestUsesSrc(t *testing.T) {
+    tests := []struct {
+        cmd  string
+        args []string
+        want bool
+    }{
+        {"telegraf --test --config {{.src}}", nil, true},
+        {"", []string{"telegraf", "--config", "{{ .src }}"}, true},
+        {"sh -c 'check $CONFD_SRC'", nil, true},
+        {"telegraf --test --config {{.dest}}", nil, false},
+        {"", []string{"nginx", "-t"}, false},
+    }
+    for _, tt := range tests {
+        if got := usesSrc(tt.cmd, tt.args); got != tt.want {
+            t.Errorf("usesSrc(%q, %q) = %v, want %v", tt.cmd, tt.args, got, tt.want)
+        }
+    }
+}
+
+func TestNoopDirs(t *testing.T) {
+    dir := t.TempDir()
+    name := filepath.Join(dir, "confd.toml")
+    content := "[global]\ncache_dir = \"" + filepath.Join(dir, "cache") + "\"\nhistory_dir = \"" + filepath.Join(dir, "history") + "\"\n"
+    ioutil.WriteFile(name, []byte(content), 0644)
+
+    // -noop ничего не создает на диске
+    a := NewAgent(name, "", false, "", true)
+    if _, err := a.Load(); err != nil {
+        t.Fatal(err)
+    }
+    for _, d := range []string{"cache", "history"} {
+        if _, err := os.Stat(filepath.Join(dir, d)); !os.IsNotExist(err) {
+            t.Errorf("%s directory is created with noop: %v", d, err)
+        }
+    }
+    if a.cache == nil {
+        t.Error("cached responses are not available with noop")
+    }
+}
+
+func TestLoadFailedKeepsState(t *testing.T) {
+    dir := t.TempDir()
+    name := filepath.Join(dir, "confd.toml")
+    ioutil.WriteFile(name, []byte("[global]\n[global.reload_groups.a]\nreload_cmd = \"true\"\n"), 0644)
+
+    a := NewAgent(name, "", false, "", true)
+    if _, err := a.Load(); err != nil {
+        t.Fatal(err)
+    }
+    before, hash := a.shared, a.hash
+
+    // Ошибка в шаблоне после изменения global не меняет состояние агента
+    content := "[global]\nurls = [\"http://127.0.0.1:1\"]\n[global.reload_groups.b]\nreload_cmd = \"true\"\n" +
+        "[[templates]]\ndest = \"/tmp/a\"\nreload_group = \"a\"\n"
+    ioutil.WriteFile(name, []byte(content), 0644)
+    if _, err := a.Load(); err == nil {
+        t.Fatal("Load() of the template with unknown reload group error = nil")
+    }
+    if a.global != before.global || a.groups["a"] != before.groups["a"] || a.changes != before.changes || a.hash != hash {
+        t.Error("failed Load changed the agent state")
+    }
+}
+
+func TestSrcPolicy(t *testing.T) {
+    dir := t.TempDir()
+    name := filepath.Join(dir, "confd.toml")
+    content := "[global.functions]\ngroups = [\"time\"]\n" +
+        "[[templates]]\nsrc = \"a.tmpl\"\ndest = \"/tmp/a\"\n[templates.functions]\ngroups = [\"dns\"]\n" +
+        "[[templates]]\nsrc = \"b.tmpl\"\ndest = \"/tmp/b\"\n"
+    ioutil.WriteFile(name, []byte(content), 0644)
+
+    tests := []struct {
+        src   string
+        group string
+    }{
+        {"a.tmpl", "dns"},
+        {"./a.tmpl", "dns"},
+        {"b.tmpl", "time"},
+        {"other.tmpl", "time"},
+    }
+    for _, tt := range tests {
+        p, err := srcPolicy(name, tt.src)
+        if err != nil || p == nil || len(p.Groups) != 1 || p.Groups[0] != tt.group {
+            t.Errorf("srcPolicy(%q) = %+v, %v, want group %s", tt.src, p, err, tt.group)
+        }
+    }
+
+    // Без файла конфигурации функции окружения отключены
+    if p, err := srcPolicy(filepath.Join(dir, "missing.toml"), "a.tmpl"); p != nil || err != nil {
+        t.Errorf("srcPolicy() of a missing file = %+v, %v", p, err)
+    }
+}
+
+func TestRunTestsPolicy(t *testing.T) {
+    dir := t.TempDir()
+    src := filepath.Join(dir, "host.tmpl")
+    ioutil.WriteFile(src, []byte(`host = {{ if hostname }}ok{{ end }}`), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`{}`), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "a.out"), []byte(`host = ok`), 0644)
+
+    // Без политики функции окружения отключены и проверка не проходит
+    if failed, err := runTests(dir, src, "", false, nil); err != nil || failed != 1 {
+        t.Errorf("runTests() without policy = %d, %v, want 1 failed", failed, err)
+    }
+    policy := &template.Policy{Groups: []string{"host"}}
+    if failed, err := runTests(dir, src, "", false, policy); err != nil || failed != 0 {
+        t.Errorf("runTests() with the host group = %d, %v, want none failed", failed, err)
+    }
+}
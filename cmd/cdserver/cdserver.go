@@ -1,103 +1,29 @@
 package main
 
 import (
-    "net"
-    "net/url"
     "net/http"
     _ "net/http/pprof"
     "flag"
     "log"
     "fmt"
     "os"
+    "io/ioutil"
     "os/signal"
     "syscall"
-    "sync"
-    "sort"
     "time"
+    "context"
     //"strings"
     "gopkg.in/natefinch/lumberjack.v2"
     "github.com/prometheus/client_golang/prometheus/promhttp"
-    "github.com/ltkh/confd/internal/api/v1"
-    "github.com/ltkh/confd/internal/api/v2"
     "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/secret"
+    "github.com/ltkh/confd/internal/server"
 )
 
 var (
     Version = "unknown"
 )
 
-type Result struct {
-    Address string
-    Latency time.Duration
-    Error   error
-}
-
-func checkAddr(name, addr string, timeout time.Duration, wg *sync.WaitGroup, results chan<- Result) {
-    defer wg.Done()
-
-    start := time.Now()
-    conn, err := net.DialTimeout("tcp", addr, timeout)
-    duration := time.Since(start)
-
-    if err == nil {
-        conn.Close()
-    }
-
-    results <- Result{
-        Address: name,
-        Latency: duration,
-        Error:   err,
-    }
-}
-
-func checkServers(servers []string) ([]string, error) {
-    resultsChan := make(chan Result, len(servers))
-    var wg sync.WaitGroup
-
-    // Запускаем проверки параллельно
-    for _, addr := range servers {
-        u, err := url.Parse(addr)
-        if err != nil {
-            return []string{}, err
-        }
-
-        wg.Add(1)
-        go checkAddr(addr, u.Host, 5 * time.Second, &wg, resultsChan)
-    }
-
-    // Ждем завершения и закрываем канал
-    wg.Wait()
-    close(resultsChan)
-
-    // Собираем результаты в слайс
-    var resultsStruct []Result
-    for res := range resultsChan {
-        resultsStruct = append(resultsStruct, res)
-    }
-
-    // Сортируем: сначала рабочие по времени, затем — упавшие
-    sort.Slice(resultsStruct, func(i, j int) bool {
-        // 1. Если у i ошибка, а у j нет — i должен быть в конце (возвращаем false)
-        if resultsStruct[i].Error != nil && resultsStruct[j].Error == nil {
-            return false
-        }
-        // 2. Если у j ошибка, а у i нет — i должен быть в начале (возвращаем true)
-        if resultsStruct[i].Error == nil && resultsStruct[j].Error != nil {
-            return true
-        }
-        // 3. Если оба либо с ошибками, либо оба ОК — сортируем по времени
-        return resultsStruct[i].Latency < resultsStruct[j].Latency
-    })
-
-    var results []string
-    for _, res := range resultsStruct {
-        //log.Printf("[info] latency %v: %v (%v), err: %v", i, res.Address, res.Latency, res.Error)
-        results = append(results, res.Address)
-    }
-
-    return results, nil
-}
-
 func main() {
 
     // Command-line flag parsing
@@ -108,7 +34,11 @@ func main() {
     logMaxBackups  := flag.Int("log.max-backups", 3, "log max backups")
     logMaxAge      := flag.Int("log.max-age", 10, "log max age")
     logCompress    := flag.Bool("log.compress", true, "log compress")
+    shutdownTimeout := flag.Duration("web.shutdown-timeout", 30 * time.Second, "time to wait for requests to finish on shutdown")
     version        := flag.Bool("version", false, "show cdserver version")
+    cfCheck        := flag.Bool("config.check", false, "check configuration file and exit")
+    keyFile        := flag.String("secret.key-file", "", "file with the key for enc: values (default $CDSERVER_SECRET_KEY)")
+    encryptValue   := flag.String("secret.encrypt", "", "print the enc: value for the string and exit")
     flag.Parse()
 
     // Show version
@@ -117,14 +47,45 @@ func main() {
         return
     }
 
-    // Program completion signal processing
-    c := make(chan os.Signal, 2)
-    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-    go func() {
-        <-c
-        log.Print("[info] cdserver stopped")
-        os.Exit(0)
-    }()
+    // Loading secret key
+    if err := secret.LoadKey(*keyFile, "CDSERVER_SECRET_KEY"); err != nil {
+        log.Fatalf("[error] loading secret key: %v", err)
+    }
+
+    // Encrypt
+    if *encryptValue != "" {
+        value, err := secret.Encrypt(*encryptValue)
+        if err != nil {
+            log.Fatalf("[error] %v", err)
+        }
+        fmt.Printf("%s\n", value)
+        return
+    }
+
+    // Check configuration file
+    if *cfCheck {
+        content, err := ioutil.ReadFile(*cfFile)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%v\n", err)
+            os.Exit(1)
+        }
+
+        _, problems := config.CheckConfig(*cfFile, content)
+
+        failed := false
+        for _, p := range problems {
+            if p.Level == "error" {
+                failed = true
+            }
+            fmt.Fprintf(os.Stderr, "%v\n", p)
+        }
+        if failed {
+            os.Exit(1)
+        }
+
+        fmt.Printf("%s: configuration is valid\n", *cfFile)
+        return
+    }
 
     // Loading configuration file
     cfg, err := config.LoadConfigFile(*cfFile)
@@ -143,52 +104,71 @@ func main() {
         })
     }
 
+    srv := server.New(*cfFile)
+    if err := srv.Apply(cfg); err != nil {
+        log.Fatalf("[error] %v", err)
+    }
+
+    httpServer := &http.Server{ Addr: *lsAddress }
+    stopped := make(chan struct{})
+
+    // Program signal processing
+    c := make(chan os.Signal, 2)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+    go func() {
+        for {
+            s := <-c
+            switch s {
+                case syscall.SIGHUP:
+                    if err := srv.Reload(); err != nil {
+                        log.Printf("[error] reloading configuration file: %v", err)
+                        continue
+                    }
+                    log.Print("[info] configuration reloaded")
+                default:
+                    log.Print("[info] cdserver is shutting down")
+
+                    // Прерываем ожидающие запросы и ждем завершения остальных
+                    srv.Drain()
+                    ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+                    if err := httpServer.Shutdown(ctx); err != nil {
+                        log.Printf("[error] shutting down: %v", err)
+                    }
+                    cancel()
+
+                    srv.Close()
+                    close(stopped)
+                    return
+            }
+        }
+    }()
+
     http.HandleFunc("/-/healthy", func (w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Content-Type", "text/plain")
         w.Write([]byte("OK"))
     })
 
-    http.Handle("/metrics", promhttp.Handler())
+    http.HandleFunc("/-/ready", srv.ReadyHandler)
 
-    for _, back := range cfg.Backends {
+    http.HandleFunc("/-/reload", srv.ReloadHandler)
 
-        //log.Printf("[info] latency check for \"%v\"", back.Id)
-        nodes, err := checkServers(back.Nodes)
-        if err != nil {
-            log.Fatalf("[error] %v", err)
-        }
-        back.Nodes = nodes
+    http.HandleFunc("/-/render/", srv.RenderHandler)
 
-        if back.Backend == "etcd" {
-            etcdClient, err := v2.GetEtcdClient(back, cfg.Logger)
-            if err != nil {
-                log.Fatalf("[error] %v", err)
-            }
-            http.Handle("/api/v2/"+back.Id, etcdClient)
-            http.Handle("/api/v2/"+back.Id+"/", etcdClient)
-        }
-
-        if back.Backend == "consul" {
-            consulClient, err := v1.GetConsulClient(back)
-            if err != nil {
-                log.Fatalf("[error] %v", err)
-            }
-            http.Handle("/api/v1/"+back.Id, &v1.ApiConsul{Id: back.Id, Client: consulClient})
-            http.Handle("/api/v1/"+back.Id+"/", &v1.ApiConsul{Id: back.Id, Client: consulClient})
-        }
+    http.Handle("/metrics", promhttp.Handler())
 
-    }
+    http.Handle("/api/", srv)
 
     log.Print("[info] cdserver started")
 
     if cfg.Global.CertFile != "" && cfg.Global.CertKey != "" {
-        if err := http.ListenAndServeTLS(*lsAddress, cfg.Global.CertFile, cfg.Global.CertKey, nil); err != nil {
-            log.Fatalf("[error] %v", err)
-        }
+        err = httpServer.ListenAndServeTLS(cfg.Global.CertFile, cfg.Global.CertKey)
     } else {
-        if err := http.ListenAndServe(*lsAddress, nil); err != nil {
-            log.Fatalf("[error] %v", err)
-        }
+        err = httpServer.ListenAndServe()
+    }
+    if err != http.ErrServerClosed {
+        log.Fatalf("[error] %v", err)
     }
 
-}
\ No newline at end of file
+    <-stopped
+    log.Print("[info] cdserver stopped")
+}
@@ -2,6 +2,7 @@ package v1
 
 import (
     "log"
+    "sync"
     "net/http"
     "regexp"
     "strings"
@@ -14,6 +15,8 @@ import (
 type ApiConsul struct {
     Id             string
     Client         *api.Client
+    Backend        config.Backend
+    lock           sync.RWMutex
 }
 
 func getConsulNodes(nodes api.KVPairs) (map[string]interface{}) {
@@ -72,10 +75,30 @@ func GetConsulClient(back config.Backend) (*api.Client, error) {
 	return client, nil
 }
 
+// SetNodes recreates the client against the first of the given nodes.
+func (a *ApiConsul) SetNodes(nodes []string) error {
+    back := a.Backend
+    back.Nodes = nodes
+
+    client, err := GetConsulClient(back)
+    if err != nil {
+        return err
+    }
+
+    a.lock.Lock()
+    a.Client = client
+    a.lock.Unlock()
+
+    return nil
+}
+
 func (a *ApiConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
     path := strings.Replace(r.URL.Path, "/api/v1/"+a.Id, "", 1)
+
+    a.lock.RLock()
     clkv := a.Client.KV()
+    a.lock.RUnlock()
 
     if r.Method == http.MethodGet {
 
@@ -24,7 +24,6 @@ import (
 
 var (
     keyRegexp = regexp.MustCompile(`.*/([^/]+)$`)
-    store = newStore()
 )
 
 type ApiEtcd struct {
@@ -34,6 +33,14 @@ type ApiEtcd struct {
     Backend       *config.Backend
     Actions       chan *config.Action
     Debug         bool
+    store         *Store
+    logger        config.Logger
+    lock          sync.RWMutex
+    ctx           context.Context
+    cancel        context.CancelFunc
+    waitCtx       context.Context
+    waitCancel    context.CancelFunc
+    wg            sync.WaitGroup
 }
 
 type errResp struct {
@@ -385,8 +392,8 @@ func (s *Store) GetCache(path string) (*client.Node, bool) {
     return nd, true
 }
 
-func StoreUpdate(kapi client.KeysAPI) error {
-    resp, err := kapi.Get(context.Background(), "/", &client.GetOptions{ Recursive: true, Sort: true })
+func StoreUpdate(ctx context.Context, store *Store, kapi client.KeysAPI) error {
+    resp, err := kapi.Get(ctx, "/", &client.GetOptions{ Recursive: true, Sort: true })
     if err != nil {
         return err
     }
@@ -440,30 +447,20 @@ func GetEtcdClient(backend config.Backend, logger config.Logger) (*ApiEtcd, erro
         return nil, err
     }
 
+    ctx, cancel := context.WithCancel(context.Background())
+    store := newStore()
+    watch := false
+
     if backend.Cache == true {
         kapi := client.NewKeysAPI(readClient)
 
         // Заполняем cache
-        if err := StoreUpdate(kapi); err != nil {
+        if err := StoreUpdate(ctx, store, kapi); err != nil {
+            cancel()
             return nil, err
         }
 
-        // Создаем watcher на ключ или префикс
-        watcher := kapi.Watcher("/", &client.WatcherOptions{ Recursive: true })
-
-        // Запускаем цикл получения событий
-        go func() {
-            for {
-                resp, err := watcher.Next(context.Background())
-                if err != nil {
-                    log.Printf("[error] %v", err)
-                    time.Sleep(10 * time.Second)
-                    StoreUpdate(kapi)
-                    continue
-                }
-                store.Update(resp.Action, resp.Node)
-            }
-        }()
+        watch = true
     }
 
     writeClient, err := client.New(client.Config{
@@ -474,9 +471,12 @@ func GetEtcdClient(backend config.Backend, logger config.Logger) (*ApiEtcd, erro
         HeaderTimeoutPerRequest: 5 * time.Second,
     })
     if err != nil {
+        cancel()
         return nil, err
     }
 
+    waitCtx, waitCancel := context.WithCancel(ctx)
+
     api := &ApiEtcd{
         Id:            backend.Id,
         ReadClient:    &readClient,
@@ -484,10 +484,49 @@ func GetEtcdClient(backend config.Backend, logger config.Logger) (*ApiEtcd, erro
         Backend:       &backend,
         Actions:       make(chan *config.Action, 1000),
         Debug:         backend.Debug,
+        store:         store,
+        logger:        logger,
+        ctx:           ctx,
+        cancel:        cancel,
+        waitCtx:       waitCtx,
+        waitCancel:    waitCancel,
+    }
+
+    if watch {
+        kapi := client.NewKeysAPI(readClient)
+
+        // Создаем watcher на ключ или префикс
+        watcher := kapi.Watcher("/", &client.WatcherOptions{ Recursive: true })
+
+        // Запускаем цикл получения событий
+        api.wg.Add(1)
+        go func() {
+            defer api.wg.Done()
+            for {
+                resp, err := watcher.Next(ctx)
+                if err != nil {
+                    if ctx.Err() != nil {
+                        return
+                    }
+                    log.Printf("[error] %v", err)
+                    select {
+                    case <-ctx.Done():
+                        return
+                    case <-time.After(10 * time.Second):
+                    }
+                    StoreUpdate(ctx, store, kapi)
+                    continue
+                }
+                store.Update(resp.Action, resp.Node)
+            }
+        }()
     }
 
     // Send new action
-    go func(logger config.Logger){
+    api.wg.Add(1)
+    go func(){
+        defer api.wg.Done()
+
         client := &http.Client{
             Transport: &http.Transport{
                 MaxIdleConnsPerHost: 10,
@@ -509,17 +548,86 @@ func GetEtcdClient(backend config.Backend, logger config.Logger) (*ApiEtcd, erro
                 actions.Array = append(actions.Array, *act) 
             case <-ticker.C:
                 if len(actions.Array) > 0 {
-                    api.SendActions(client, actions, logger.Urls)
+                    api.SendActions(client, actions, api.GetLogger().Urls)
                     actions.Array = nil
                 }
+            case <-ctx.Done():
+                // Отправляем накопленные действия перед завершением
+                for {
+                    select {
+                    case act := <-api.Actions:
+                        actions.Array = append(actions.Array, *act)
+                        continue
+                    default:
+                    }
+                    break
+                }
+                if len(actions.Array) > 0 {
+                    api.SendActions(client, actions, api.GetLogger().Urls)
+                }
+                return
             }
         }
 
-    }(logger)
+    }()
 
     return api, nil
 }
 
+// GetBackend returns the current backend settings.
+func (a *ApiEtcd) GetBackend() *config.Backend {
+    a.lock.RLock()
+    defer a.lock.RUnlock()
+    return a.Backend
+}
+
+// SetBackend replaces the checks and debug settings of the backend,
+// keeping its clients and cache.
+func (a *ApiEtcd) SetBackend(backend *config.Backend) {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    a.Backend = backend
+    a.Debug = backend.Debug
+}
+
+// GetLogger returns the current logger settings.
+func (a *ApiEtcd) GetLogger() config.Logger {
+    a.lock.RLock()
+    defer a.lock.RUnlock()
+    return a.logger
+}
+
+// SetLogger replaces the logger settings.
+func (a *ApiEtcd) SetLogger(logger config.Logger) {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    a.logger = logger
+}
+
+// Drain interrupts pending and future wait requests,
+// which are answered with a retryable status.
+func (a *ApiEtcd) Drain() {
+    a.waitCancel()
+}
+
+// Close stops the cache watcher and waits until the pending
+// actions have been sent.
+func (a *ApiEtcd) Close() {
+    a.cancel()
+    a.wg.Wait()
+}
+
+// SetNodes replaces the endpoints used by the read and write clients.
+func (a *ApiEtcd) SetNodes(nodes []string) error {
+    if err := (*a.ReadClient).SetEndpoints(nodes); err != nil {
+        return err
+    }
+    if err := (*a.WriteClient).SetEndpoints(nodes); err != nil {
+        return err
+    }
+    return nil
+}
+
 func (a *ApiEtcd) SendActions(client *http.Client, actions Actions, urls []string) {
     data, err := json.Marshal(actions)
     if err != nil {
@@ -543,7 +651,11 @@ func (a *ApiEtcd) SendActions(client *http.Client, actions Actions, urls []strin
 }
 
 func (a *ApiEtcd) SetAction(tp, user, err, cache string, r *http.Request, code int) {
-    if (a.Debug && tp == "debug") || tp != "debug" {
+    a.lock.RLock()
+    debug := a.Debug
+    a.lock.RUnlock()
+
+    if (debug && tp == "debug") || tp != "debug" {
         if user == "" { user = "-" }
         log.Printf("[%s] %s - %s \"%s %s%s\" %v %s", tp, getIPAddress(r), user, r.Method, r.URL.Path, cache, code, err)
     }
@@ -572,6 +684,13 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     path := strings.Replace(r.URL.Path, "/api/v2/"+a.Id, "", 1)
     user, pass, _ := r.BasicAuth()
     cache := ""
+    backend := a.GetBackend()
+
+    // С настроенными шаблонами префикс /render зарезервирован за ними
+    if strings.HasPrefix(path, "/render/") && (backend.Templates.Dir != "" || backend.Templates.Prefix != "") {
+        a.ServeRender(w, r, strings.TrimPrefix(path, "/render/"))
+        return
+    }
 
     params, err := parseForm(r)
     if err != nil {
@@ -595,7 +714,7 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         opts.Dir = true
     }
 
-    code, errCode, err := backendChecks(a.Backend, params, path, user, pass, strings.ToLower(r.Method))
+    code, errCode, err := backendChecks(backend, params, path, user, pass, strings.ToLower(r.Method))
     if err != nil {
         a.SetAction("error", user, err.Error(), cache, r, code)
         w.WriteHeader(code)
@@ -609,15 +728,27 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
         if opts.Wait {
             // Создаем watcher на ключ или префикс
+            ctx, cancel := context.WithCancel(r.Context())
+            defer cancel()
+            stop := context.AfterFunc(a.waitCtx, cancel)
+            defer stop()
+
             watcher := kapi.Watcher(path, &client.WatcherOptions{ Recursive: opts.Recursive })
-            resp, err = watcher.Next(context.Background())
+            resp, err = watcher.Next(ctx)
             if err != nil {
+                if a.waitCtx.Err() != nil {
+                    a.SetAction("debug", user, "server is shutting down", cache, r, 503)
+                    w.Header().Set("Retry-After", "5")
+                    w.WriteHeader(503)
+                    w.Write(encodeResp(&errResp{Error:503, Message:"Service Unavailable", Cause: path}))
+                    return
+                }
                 a.SetAction("error", user, err.Error(), cache, r, 500)
                 w.WriteHeader(500)
                 w.Write(encodeResp(&errResp{Error:500, Message:err.Error(), Cause: path}))
                 return
             }
-        } else if !opts.Recursive || !a.Backend.Cache {
+        } else if !opts.Recursive || !backend.Cache {
             resp, err = kapi.Get(context.Background(), path, &client.GetOptions{ Recursive: opts.Recursive, Sort: opts.Sort })
             if err != nil {
                 if etcdErr, ok := err.(client.Error); ok {
@@ -632,8 +763,8 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
                 w.WriteHeader(500)
                 return
             }
-        } else if opts.Recursive && a.Backend.Cache {
-            node, exists := store.GetCache(path)
+        } else if opts.Recursive && backend.Cache {
+            node, exists := a.store.GetCache(path)
             if !exists {
                 resp, err = kapi.Get(context.Background(), path, &client.GetOptions{ Recursive: opts.Recursive, Sort: opts.Sort })
                 if err != nil {
@@ -649,7 +780,7 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
                     w.WriteHeader(500)
                     return
                 }
-                store.Update("set", resp.Node)
+                a.store.Update("set", resp.Node)
             } else {
                 cache = " (cache)"
                 resp = &client.Response{ Node: node }
@@ -657,7 +788,7 @@ func (a *ApiEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         }
 
         // Применение ролевой модели ко всему дереву ключей
-        nodes := getAllowedNodes(a.Backend, resp.Node.Nodes, user, pass, strings.ToLower(r.Method))
+        nodes := getAllowedNodes(backend, resp.Node.Nodes, user, pass, strings.ToLower(r.Method))
 
         // Формирование ответа для агента confd
         if r.Header.Get("X-Custom-Format") == "confd" {
@@ -0,0 +1,143 @@
+package v2
+
+import (
+    "time"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+    "io/ioutil"
+    "path/filepath"
+    "github.com/ltkh/confd/internal/config"
+)
+
+// etcd answers wait requests only when the client goes away.
+func etcd(t *testing.T) *httptest.Server {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-r.Context().Done()
+    }))
+    t.Cleanup(srv.Close)
+    return srv
+}
+
+func newApi(t *testing.T, node string, logger config.Logger) *ApiEtcd {
+    backend := config.Backend{
+        Backend: "etcd",
+        Id:      "etcd",
+        Nodes:   []string{node},
+        Checks:  map[string][]*config.Scheme{"get": {{}}},
+    }
+    api, err := GetEtcdClient(backend, logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return api
+}
+
+func TestDrainWaiters(t *testing.T) {
+    api := newApi(t, etcd(t).URL, config.Logger{})
+    defer api.Close()
+
+    done := make(chan *httptest.ResponseRecorder)
+    go func() {
+        w := httptest.NewRecorder()
+        api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/etcd/key?wait=true", nil))
+        done <- w
+    }()
+
+    select {
+        case w := <-done:
+            t.Fatalf("wait request finished before Drain: %d", w.Code)
+        case <-time.After(100 * time.Millisecond):
+    }
+
+    api.Drain()
+
+    // Ожидающие и новые запросы получают повторяемый статус
+    for i := 0; i < 2; i++ {
+        var w *httptest.ResponseRecorder
+        select {
+            case w = <-done:
+            case <-time.After(5 * time.Second):
+                t.Fatal("wait request is not interrupted by Drain")
+        }
+        if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+            t.Errorf("wait request %d after Drain = %d, Retry-After %q", i, w.Code, w.Header().Get("Retry-After"))
+        }
+        if i == 0 {
+            go func() {
+                w := httptest.NewRecorder()
+                api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/etcd/key?wait=true", nil))
+                done <- w
+            }()
+        }
+    }
+}
+
+func TestCloseFlushesActions(t *testing.T) {
+    received := make(chan Actions, 10)
+    logger := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var actions Actions
+        json.NewDecoder(r.Body).Decode(&actions)
+        received <- actions
+    }))
+    defer logger.Close()
+
+    api := newApi(t, etcd(t).URL, config.Logger{Urls: []string{logger.URL}})
+    api.Actions <- &config.Action{Login: "a"}
+    api.Actions <- &config.Action{Login: "b"}
+
+    // Действия отправляются до возврата из Close, а не по таймеру
+    api.Close()
+
+    select {
+        case actions := <-received:
+            if len(actions.Array) != 2 || actions.Array[0].Login != "a" || actions.Array[1].Login != "b" {
+                t.Errorf("sent actions = %+v", actions.Array)
+            }
+        default:
+            t.Fatal("pending actions are not sent by Close")
+    }
+}
+
+func TestRender(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("X-Etcd-Index", "1")
+        switch r.URL.Path {
+            case "/v2/keys/dir":
+                w.Write([]byte(`{"action":"get","node":{"key":"/dir","dir":true,"nodes":[{"key":"/dir/a","value":"1"}]}}`))
+            case "/v2/keys/leaf":
+                w.Write([]byte(`{"action":"get","node":{"key":"/leaf","value":"1"}}`))
+            default:
+                w.WriteHeader(404)
+                w.Write([]byte(`{"errorCode":100,"message":"Key not found","cause":"` + r.URL.Path + `","index":1}`))
+        }
+    }))
+    defer srv.Close()
+
+    dir := t.TempDir()
+    ioutil.WriteFile(filepath.Join(dir, "t.tmpl"), []byte(`a={{ .a }}`), 0644)
+
+    api := newApi(t, srv.URL, config.Logger{})
+    defer api.Close()
+    api.Backend.Templates.Dir = dir
+
+    tests := []struct {
+        url  string
+        code int
+        body string
+    }{
+        {"/api/v2/etcd/render/t.tmpl?path=/dir", 200, "a=1"},
+        {"/api/v2/etcd/render/t.tmpl?path=/leaf", 400, ""},
+        {"/api/v2/etcd/render/t.tmpl?path=/missing", 404, ""},
+        {"/api/v2/etcd/render/none.tmpl?path=/dir", 404, ""},
+    }
+    for _, tt := range tests {
+        w := httptest.NewRecorder()
+        api.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+        if w.Code != tt.code || (tt.body != "" && w.Body.String() != tt.body) {
+            t.Errorf("GET %s = %d %q, want %d %q", tt.url, w.Code, w.Body.String(), tt.code, tt.body)
+        }
+    }
+}
@@ -0,0 +1,166 @@
+package v2
+
+import (
+    "os"
+    "fmt"
+    "context"
+    "net/http"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "go.etcd.io/etcd/client/v2"
+    "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/template"
+)
+
+type renderError struct {
+    code          int
+    err           error
+}
+
+func (e *renderError) Error() string {
+    return e.err.Error()
+}
+
+// loadTemplate returns the source of the template from the templates
+// directory or from the key under the templates prefix.
+func (a *ApiEtcd) loadTemplate(backend *config.Backend, name string) (string, error) {
+    if backend.Templates.Dir != "" {
+        data, err := ioutil.ReadFile(filepath.Join(backend.Templates.Dir, name))
+        if err != nil {
+            if os.IsNotExist(err) {
+                return "", &renderError{ code: 404, err: fmt.Errorf("template %q not found", name) }
+            }
+            return "", err
+        }
+        return string(data), nil
+    }
+
+    kapi := client.NewKeysAPI(*a.ReadClient)
+    resp, err := kapi.Get(context.Background(), strings.TrimSuffix(backend.Templates.Prefix, "/")+"/"+name, nil)
+    if err != nil {
+        if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == 100 {
+            return "", &renderError{ code: 404, err: fmt.Errorf("template %q not found", name) }
+        }
+        return "", err
+    }
+    if resp.Node.Dir {
+        return "", &renderError{ code: 404, err: fmt.Errorf("template %q not found", name) }
+    }
+    return resp.Node.Value, nil
+}
+
+// getNode returns the tree of keys under the path, from the cache if it is enabled.
+func (a *ApiEtcd) getNode(backend *config.Backend, path string) (*client.Node, string, error) {
+    if backend.Cache {
+        if node, exists := a.store.GetCache(path); exists {
+            return node, " (cache)", nil
+        }
+    }
+
+    kapi := client.NewKeysAPI(*a.ReadClient)
+    resp, err := kapi.Get(context.Background(), path, &client.GetOptions{ Recursive: true, Sort: true })
+    if err != nil {
+        if etcdErr, ok := err.(client.Error); ok && etcdErr.Code == 100 {
+            return nil, "", &renderError{ code: 404, err: fmt.Errorf("%s", etcdErr.Message) }
+        }
+        return nil, "", err
+    }
+    if backend.Cache {
+        a.store.Update("set", resp.Node)
+    }
+    return resp.Node, "", nil
+}
+
+// ServeRender answers GET /api/v2/<id>/render/<template>?path=<path> (and
+// /-/render/<id>/<template>) with the hosted template rendered from the keys
+// under the directory path the user may read. The response carries
+// X-Custom-Hash, 204 is returned if the agent already has this content.
+func (a *ApiEtcd) ServeRender(w http.ResponseWriter, r *http.Request, name string) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+    path := r.URL.Query().Get("path")
+    user, pass, _ := r.BasicAuth()
+    cache := ""
+    backend := a.GetBackend()
+
+    fail := func(code int, err error) {
+        level := "error"
+        if code < 500 {
+            level = "debug"
+        }
+        a.SetAction(level, user, err.Error(), cache, r, code)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(code)
+        w.Write(encodeResp(&errResp{Error:code, Message:err.Error(), Cause: path}))
+    }
+
+    if r.Method != http.MethodGet {
+        fail(405, fmt.Errorf("Method Not Allowed"))
+        return
+    }
+
+    if backend.Templates.Dir == "" && backend.Templates.Prefix == "" {
+        fail(404, fmt.Errorf("templates are not configured"))
+        return
+    }
+
+    if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+        fail(400, fmt.Errorf("invalid template name %q", name))
+        return
+    }
+    if !strings.HasPrefix(path, "/") {
+        fail(400, fmt.Errorf("path parameter must start with /"))
+        return
+    }
+
+    // Данные доступны шаблону по тем же правилам, что и при чтении ключей
+    code, _, err := backendChecks(backend, nil, path, user, pass, "get")
+    if err != nil {
+        fail(code, err)
+        return
+    }
+
+    source, err := a.loadTemplate(backend, name)
+    if err != nil {
+        if e, ok := err.(*renderError); ok {
+            fail(e.code, e)
+            return
+        }
+        fail(500, err)
+        return
+    }
+
+    node, cache, err := a.getNode(backend, path)
+    if err != nil {
+        if e, ok := err.(*renderError); ok {
+            fail(e.code, e)
+            return
+        }
+        fail(500, err)
+        return
+    }
+
+    if !node.Dir {
+        fail(400, fmt.Errorf("path %s is not a directory", path))
+        return
+    }
+
+    jsn := getEtcdNodes(getAllowedNodes(backend, node.Nodes, user, pass, "get"))
+
+    data, err := template.New(name).WithPolicy(template.Strict).Execute(source, jsn)
+    if err != nil {
+        fail(422, fmt.Errorf("rendering %s: %v", name, err))
+        return
+    }
+
+    hash := config.GetHash(data)
+    if r.Header.Get("X-Custom-Hash") == hash {
+        w.WriteHeader(204)
+        return
+    }
+
+    a.SetAction("debug", user, "", cache, r, 200)
+    w.Header().Set("X-Custom-Hash", hash)
+    w.Write(data)
+}
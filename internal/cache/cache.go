@@ -0,0 +1,69 @@
+package cache
+
+import (
+    "os"
+    "time"
+    "encoding/json"
+    "path/filepath"
+    "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/file"
+)
+
+// Cache keeps the last successful responses on disk.
+type Cache struct {
+    Dir            string
+}
+
+// Entry is a cached response.
+type Entry struct {
+    Path           string                 `json:"path"`
+    Hash           string                 `json:"hash"`
+    Time           time.Time              `json:"time"`
+    Body           json.RawMessage        `json:"body"`
+}
+
+// New returns the cache in the directory, creating it if needed.
+func New(dir string) (*Cache, error) {
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return nil, err
+    }
+    return &Cache{ Dir: dir }, nil
+}
+
+// file returns the cache file of the key.
+func (c *Cache) file(key string) string {
+    return filepath.Join(c.Dir, config.GetHash([]byte(key))+".json")
+}
+
+// Save stores the response of the key, replacing the previous one atomically.
+func (c *Cache) Save(key string, entry Entry) error {
+    data, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+
+    name := c.file(key)
+    temp, err := file.WriteTemp(name, "", data, file.Attrs{ Mode: 0600, Uid: -1, Gid: -1 })
+    if err != nil {
+        return err
+    }
+    if err := file.Install(temp, name); err != nil {
+        os.Remove(temp)
+        return err
+    }
+    return nil
+}
+
+// Load returns the stored response of the key.
+func (c *Cache) Load(key string) (*Entry, error) {
+    data, err := os.ReadFile(c.file(key))
+    if err != nil {
+        return nil, err
+    }
+
+    var entry Entry
+    if err := json.Unmarshal(data, &entry); err != nil {
+        return nil, err
+    }
+    return &entry, nil
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+    "os"
+    "time"
+    "testing"
+    "path/filepath"
+)
+
+func TestSaveLoad(t *testing.T) {
+    c, err := New(filepath.Join(t.TempDir(), "cache"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := c.Load("missing"); !os.IsNotExist(err) {
+        t.Errorf("Load(missing) error = %v, want not exist", err)
+    }
+
+    now := time.Now().UTC().Truncate(time.Second)
+    for _, body := range []string{`{"a":1}`, `{"a":2}`} {
+        entry := Entry{ Path: "/ps/hosts", Hash: "h", Time: now, Body: []byte(body) }
+        if err := c.Save("key", entry); err != nil {
+            t.Fatal(err)
+        }
+        got, err := c.Load("key")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got.Path != entry.Path || !got.Time.Equal(now) || string(got.Body) != body {
+            t.Errorf("Load() = %+v, want %+v", got, entry)
+        }
+    }
+
+    info, err := os.Stat(c.file("key"))
+    if err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("cache file mode = %v, %v, want 0600", info.Mode().Perm(), err)
+    }
+    if other, _ := c.Load("other"); other != nil {
+        t.Error("keys share the cache file")
+    }
+}
@@ -0,0 +1,227 @@
+package changes
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+    "bytes"
+    "regexp"
+    "strings"
+    "sync"
+    "net/http"
+    "encoding/json"
+    "path/filepath"
+    "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/diff"
+    "github.com/ltkh/confd/internal/file"
+)
+
+var (
+    // DefaultRedact are the patterns of secret lines used when none are configured
+    DefaultRedact = []string{`(?i)(password|passwd|secret|token)`}
+)
+
+// Config describes what is done with the changes of config files.
+type Config struct {
+    Redact         []string
+    HistoryDir     string
+    HistorySize    int
+    URL            string
+}
+
+// Reporter logs the diffs of changed config files, keeps their
+// previous versions and sends change events.
+type Reporter struct {
+    redact         []*regexp.Regexp
+    historyDir     string
+    historySize    int
+    url            string
+    host           string
+    client         *http.Client
+    wg             sync.WaitGroup
+}
+
+// Event is sent to the change URL for every changed file.
+type Event struct {
+    Template       string                 `json:"template"`
+    Dest           string                 `json:"dest"`
+    Host           string                 `json:"host"`
+    OldHash        string                 `json:"old_hash"`
+    NewHash        string                 `json:"new_hash"`
+    Diff           string                 `json:"diff"`
+    Time           time.Time              `json:"time"`
+}
+
+// New returns the reporter, history keeps 5 versions by default.
+func New(cfg Config) (*Reporter, error) {
+    r := &Reporter{
+        historyDir:  cfg.HistoryDir,
+        historySize: cfg.HistorySize,
+        url:         cfg.URL,
+        client:      &http.Client{ Timeout: 5 * time.Second },
+    }
+
+    patterns := cfg.Redact
+    if patterns == nil {
+        patterns = DefaultRedact
+    }
+    for _, p := range patterns {
+        re, err := regexp.Compile(p)
+        if err != nil {
+            return nil, fmt.Errorf("redact pattern %q: %v", p, err)
+        }
+        r.redact = append(r.redact, re)
+    }
+
+    if r.historyDir != "" {
+        if r.historySize <= 0 {
+            r.historySize = 5
+        }
+        if err := os.MkdirAll(r.historyDir, 0700); err != nil {
+            return nil, err
+        }
+    }
+
+    r.host, _ = os.Hostname()
+
+    return r, nil
+}
+
+// Diff returns the unified diff with secret lines redacted.
+func (r *Reporter) Diff(oldName, newName string, old, new []byte) (string, error) {
+    d, err := diff.Unified(oldName, newName, old, new)
+    if err != nil || d == "" {
+        return d, err
+    }
+
+    lines := strings.SplitAfter(d, "\n")
+    for i, line := range lines {
+        // Заголовки файлов - только первые две строки, строки содержимого
+        // начинаются с пробела, "+" или "-" и могут выглядеть как заголовки
+        if i < 2 || strings.HasPrefix(line, "@@ ") || line == "" {
+            continue
+        }
+        for _, re := range r.redact {
+            if re.MatchString(line[1:]) {
+                lines[i] = line[:1] + "<redacted>\n"
+                break
+            }
+        }
+    }
+
+    return strings.Join(lines, ""), nil
+}
+
+// Report logs the change of dest made by the template, saves the new
+// version into the history and sends the change event. The new content
+// is nil if dest is removed.
+func (r *Reporter) Report(template, dest string, old, new []byte) {
+    oldName, newName := dest, dest
+    if old == nil {
+        oldName = "/dev/null"
+    }
+    if new == nil {
+        newName = "/dev/null"
+    }
+
+    d, err := r.Diff(oldName, newName, old, new)
+    if err != nil {
+        log.Printf("[warn] %s: diff: %v", dest, err)
+    }
+    log.Printf("[info] %s changed:\n%s", dest, d)
+
+    if r.historyDir != "" && new != nil {
+        if err := r.save(dest, new); err != nil {
+            log.Printf("[warn] %s: saving history: %v", dest, err)
+        }
+    }
+
+    if r.url != "" {
+        event := Event{
+            Template: template,
+            Dest:     dest,
+            Host:     r.host,
+            Diff:     d,
+            Time:     time.Now(),
+        }
+        if old != nil {
+            event.OldHash = config.GetHash(old)
+        }
+        if new != nil {
+            event.NewHash = config.GetHash(new)
+        }
+        r.wg.Add(1)
+        go func() {
+            defer r.wg.Done()
+            if err := r.send(event); err != nil {
+                log.Printf("[warn] %s: sending change event: %v", dest, err)
+            }
+        }()
+    }
+}
+
+// Wait waits for the change events being sent.
+func (r *Reporter) Wait() {
+    r.wg.Wait()
+}
+
+// save writes the version of dest into the history and removes the oldest ones.
+func (r *Reporter) save(dest string, cont []byte) error {
+    name := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(strings.TrimLeft(dest, "/\\"))
+    dir := filepath.Join(r.historyDir, name)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return err
+    }
+
+    version := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000"))
+    temp, err := file.WriteTemp(version, "", cont, file.Attrs{ Mode: 0600, Uid: -1, Gid: -1 })
+    if err != nil {
+        return err
+    }
+    if err := file.Install(temp, version); err != nil {
+        os.Remove(temp)
+        return err
+    }
+
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return err
+    }
+
+    var versions []string
+    for _, e := range entries {
+        if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+            versions = append(versions, e.Name())
+        }
+    }
+    sort.Strings(versions)
+
+    for len(versions) > r.historySize {
+        if err := os.Remove(filepath.Join(dir, versions[0])); err != nil {
+            return err
+        }
+        versions = versions[1:]
+    }
+
+    return nil
+}
+
+func (r *Reporter) send(event Event) error {
+    data, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+
+    resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(data))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("received status code: %d", resp.StatusCode)
+    }
+    return nil
+}
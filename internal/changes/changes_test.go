@@ -0,0 +1,127 @@
+package changes
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "encoding/json"
+    "path/filepath"
+)
+
+func TestDiffRedact(t *testing.T) {
+    r, err := New(Config{})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name string
+        old  string
+        new  string
+        want []string
+        hide []string
+    }{
+        {
+            name: "plain",
+            old:  "user = a\npassword = old\n",
+            new:  "user = a\npassword = new\n",
+            want: []string{"--- dest\n", "+++ dest\n", "-<redacted>\n", "+<redacted>\n", " user = a\n"},
+            hide: []string{"old", "new"},
+        },
+        {
+            // Строки содержимого, похожие на заголовки
+            name: "header-like",
+            old:  "--password=old\n",
+            new:  "++token=new\n",
+            want: []string{"--- dest\n", "+++ dest\n", "-<redacted>\n", "+<redacted>\n"},
+            hide: []string{"old", "new"},
+        },
+        {
+            name: "hunk-like",
+            old:  "a\n",
+            new:  "@@ secret=new\n",
+            want: []string{"@@ -1 +1 @@\n", "+<redacted>\n"},
+            hide: []string{"new"},
+        },
+    }
+
+    for _, tt := range tests {
+        d, err := r.Diff("dest", "dest", []byte(tt.old), []byte(tt.new))
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, w := range tt.want {
+            if !strings.Contains(d, w) {
+                t.Errorf("%s: diff has no %q:\n%s", tt.name, w, d)
+            }
+        }
+        for _, h := range tt.hide {
+            if strings.Contains(d, h) {
+                t.Errorf("%s: diff shows %q:\n%s", tt.name, h, d)
+            }
+        }
+    }
+}
+
+func TestRedactPattern(t *testing.T) {
+    if _, err := New(Config{Redact: []string{"("}}); err == nil {
+        t.Error("invalid pattern is accepted")
+    }
+
+    r, _ := New(Config{Redact: []string{}})
+    d, _ := r.Diff("dest", "dest", []byte("password = a\n"), []byte("password = b\n"))
+    if strings.Contains(d, "<redacted>") {
+        t.Errorf("empty pattern list redacts:\n%s", d)
+    }
+}
+
+func TestHistory(t *testing.T) {
+    dir := t.TempDir()
+    r, err := New(Config{HistoryDir: dir, HistorySize: 2, Redact: []string{}})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, v := range []string{"1", "2", "3"} {
+        r.Report("tmpl", "/etc/app.conf", []byte("old"), []byte(v))
+    }
+
+    entries, err := os.ReadDir(filepath.Join(dir, "etc_app.conf"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 2 {
+        t.Fatalf("%d versions kept, want 2", len(entries))
+    }
+    data, _ := os.ReadFile(filepath.Join(dir, "etc_app.conf", entries[1].Name()))
+    if string(data) != "3" {
+        t.Errorf("last version = %q, want 3", data)
+    }
+}
+
+func TestEvent(t *testing.T) {
+    events := make(chan Event, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var e Event
+        json.NewDecoder(r.Body).Decode(&e)
+        events <- e
+    }))
+    defer srv.Close()
+
+    r, err := New(Config{URL: srv.URL})
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.Report("tmpl", "/etc/app.conf", nil, []byte("token = x\n"))
+    r.Wait()
+
+    e := <-events
+    if e.Template != "tmpl" || e.OldHash != "" || e.NewHash == "" {
+        t.Errorf("event = %+v", e)
+    }
+    if strings.Contains(e.Diff, "token = x") || !strings.Contains(e.Diff, "--- /dev/null") {
+        t.Errorf("event diff:\n%s", e.Diff)
+    }
+}
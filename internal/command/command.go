@@ -0,0 +1,128 @@
+package command
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "context"
+    "runtime"
+    "strings"
+    "os/exec"
+)
+
+const (
+    // maxOutput limits the command output written to the log
+    maxOutput = 4096
+)
+
+// Command is an external command run by the agent: either a shell
+// command line (Cmd) or an argument vector executed without a shell (Args).
+type Command struct {
+    Cmd            string
+    Args           []string
+    Timeout        time.Duration
+    Env            map[string]string
+    Retries        int
+    RetryInterval  time.Duration
+}
+
+// String returns the command line for logging.
+func (c *Command) String() string {
+    if len(c.Args) > 0 {
+        return strings.Join(c.Args, " ")
+    }
+    return c.Cmd
+}
+
+func (c *Command) command(ctx context.Context) *exec.Cmd {
+    var cmd *exec.Cmd
+    if len(c.Args) > 0 {
+        cmd = exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+    } else if runtime.GOOS == "windows" {
+        cmd = exec.CommandContext(ctx, "cmd", "/C", c.Cmd)
+    } else {
+        cmd = exec.CommandContext(ctx, "/bin/sh", "-c", c.Cmd)
+    }
+
+    if len(c.Env) > 0 {
+        cmd.Env = os.Environ()
+        for name, value := range c.Env {
+            cmd.Env = append(cmd.Env, name+"="+value)
+        }
+    }
+
+    return cmd
+}
+
+func trimOutput(data []byte) string {
+    out := strings.TrimSpace(string(data))
+    if len(out) > maxOutput {
+        out = out[:maxOutput] + "..."
+    }
+    return out
+}
+
+func (c *Command) run() ([]byte, error) {
+    timeout := c.Timeout
+    if timeout <= 0 {
+        timeout = 10 * time.Second
+    }
+
+    // Create a new context and add a timeout to it
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    var stdout, stderr bytes.Buffer
+    cmd := c.command(ctx)
+    cmd.Stdout = &stdout
+    cmd.Stderr = &stderr
+    // Не ждем дочерние процессы, удерживающие вывод после таймаута
+    cmd.WaitDelay = time.Second
+
+    err := cmd.Run()
+
+    if out := trimOutput(stdout.Bytes()); out != "" {
+        log.Printf("[info] '%s' stdout: %s", c, out)
+    }
+    if out := trimOutput(stderr.Bytes()); out != "" {
+        log.Printf("[warn] '%s' stderr: %s", c, out)
+    }
+
+    // Check the context error to see if the timeout was executed
+    if ctx.Err() == context.DeadlineExceeded {
+        return nil, fmt.Errorf("command timed out after %v '%s'", timeout, c)
+    }
+
+    if err != nil {
+        if out := trimOutput(stderr.Bytes()); out != "" {
+            return nil, fmt.Errorf("non-zero exit code: %v '%s': %s", err, c, out)
+        }
+        return nil, fmt.Errorf("non-zero exit code: %v '%s'", err, c)
+    }
+
+    return stdout.Bytes(), nil
+}
+
+// Run executes the command, repeating it up to Retries times on failure.
+func (c *Command) Run() ([]byte, error) {
+    var out []byte
+    var err error
+
+    for attempt := 0; attempt <= c.Retries; attempt++ {
+        if attempt > 0 {
+            log.Printf("[warn] retrying '%s' (%d/%d): %v", c, attempt, c.Retries, err)
+            time.Sleep(c.RetryInterval)
+        }
+
+        log.Printf("[info] running '%s'", c)
+        out, err = c.run()
+        if err == nil {
+            log.Printf("[info] finished '%s'", c)
+            return out, nil
+        }
+    }
+
+    return nil, err
+}
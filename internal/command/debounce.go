@@ -0,0 +1,104 @@
+package command
+
+import (
+    "sync"
+    "time"
+)
+
+// Debouncer runs the command once for all calls of Run made
+// within the window after each other, but not later than MaxDelay
+// after the first of them.
+type Debouncer struct {
+    Command        *Command
+    Window         time.Duration
+    MaxDelay       time.Duration
+    lock           sync.Mutex
+    run            sync.Mutex
+    timer          *time.Timer
+    first          time.Time
+    waiters        []*waiter
+}
+
+type waiter struct {
+    rollback       func() error
+    result         chan [2]error
+}
+
+// NewDebouncer returns a debouncer of the command, maxDelay 0 is unlimited.
+func NewDebouncer(cmd *Command, window, maxDelay time.Duration) *Debouncer {
+    return &Debouncer{ Command: cmd, Window: window, MaxDelay: maxDelay }
+}
+
+// Run schedules the command and waits for the result of its next run.
+// When the command fails, the rollbacks of all callers of this run are
+// called first and then the command runs once more, rerr is the error
+// of the rollback or of this second run.
+func (d *Debouncer) Run(rollback func() error) (err, rerr error) {
+    w := &waiter{ rollback: rollback, result: make(chan [2]error, 1) }
+
+    d.lock.Lock()
+    d.waiters = append(d.waiters, w)
+    if d.timer == nil {
+        d.first = time.Now()
+        d.timer = time.AfterFunc(d.Window, d.fire)
+    } else {
+        // Постоянные изменения не откладывают запуск дольше MaxDelay
+        wait := d.Window
+        if d.MaxDelay > 0 {
+            if left := d.MaxDelay - time.Since(d.first); left < wait {
+                wait = left
+            }
+        }
+        if wait < 0 {
+            wait = 0
+        }
+        d.timer.Reset(wait)
+    }
+    d.lock.Unlock()
+
+    res := <-w.result
+    return res[0], res[1]
+}
+
+func (d *Debouncer) fire() {
+    d.lock.Lock()
+    waiters := d.waiters
+    d.waiters = nil
+    d.timer = nil
+    d.lock.Unlock()
+
+    // Таймер мог быть перезапущен после срабатывания
+    if len(waiters) == 0 {
+        return
+    }
+
+    // Запуски команды не пересекаются
+    d.run.Lock()
+    defer d.run.Unlock()
+
+    _, err := d.Command.Run()
+
+    rerrs := make([]error, len(waiters))
+    if err != nil {
+        // Сначала откатываются все файлы, затем команда запускается один раз
+        rollback := false
+        for i, w := range waiters {
+            if w.rollback != nil {
+                rerrs[i] = w.rollback()
+                rollback = true
+            }
+        }
+        if rollback {
+            _, rerr := d.Command.Run()
+            for i, w := range waiters {
+                if w.rollback != nil && rerrs[i] == nil {
+                    rerrs[i] = rerr
+                }
+            }
+        }
+    }
+
+    for i, w := range waiters {
+        w.result <- [2]error{ err, rerrs[i] }
+    }
+}
@@ -0,0 +1,129 @@
+package command
+
+import (
+    "sync"
+    "time"
+    "errors"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// counter returns a command appending a line to the file on every run.
+func counter(t *testing.T, fail bool) (*Command, func() int) {
+    name := filepath.Join(t.TempDir(), "runs")
+    code := "0"
+    if fail {
+        code = "1"
+    }
+    cmd := &Command{ Args: []string{"sh", "-c", "echo run >> " + name + "; exit " + code} }
+    runs := func() int {
+        data, _ := ioutil.ReadFile(name)
+        n := 0
+        for _, b := range data {
+            if b == '\n' {
+                n++
+            }
+        }
+        return n
+    }
+    return cmd, runs
+}
+
+func TestDebouncerBatches(t *testing.T) {
+    cmd, runs := counter(t, false)
+    d := NewDebouncer(cmd, 100 * time.Millisecond, 0)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 3; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if err, rerr := d.Run(nil); err != nil || rerr != nil {
+                t.Errorf("Run() = %v, %v", err, rerr)
+            }
+        }()
+        time.Sleep(20 * time.Millisecond)
+    }
+    wg.Wait()
+
+    if n := runs(); n != 1 {
+        t.Errorf("command ran %d times, want 1", n)
+    }
+}
+
+func TestDebouncerMaxDelay(t *testing.T) {
+    cmd, runs := counter(t, false)
+    d := NewDebouncer(cmd, 100 * time.Millisecond, 300 * time.Millisecond)
+
+    // Изменения чаще окна не должны откладывать запуск бесконечно
+    done := make(chan struct{})
+    go func() {
+        d.Run(nil)
+        close(done)
+    }()
+    stop := time.After(time.Second)
+    ticker := time.NewTicker(50 * time.Millisecond)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-done:
+                if runs() == 0 {
+                    t.Error("command did not run")
+                }
+                return
+            case <-ticker.C:
+                go d.Run(nil)
+            case <-stop:
+                t.Fatal("command did not run within max delay")
+        }
+    }
+}
+
+func TestDebouncerRollbackOnce(t *testing.T) {
+    cmd, runs := counter(t, true)
+    d := NewDebouncer(cmd, 50 * time.Millisecond, 0)
+
+    var lock sync.Mutex
+    rollbacks := 0
+    restored := func() error {
+        lock.Lock()
+        rollbacks++
+        lock.Unlock()
+        return nil
+    }
+    broken := errors.New("restore failed")
+
+    var wg sync.WaitGroup
+    results := make([][2]error, 3)
+    for i := range results {
+        rollback := restored
+        if i == 2 {
+            rollback = func() error { restored(); return broken }
+        }
+        wg.Add(1)
+        go func(i int, rollback func() error) {
+            defer wg.Done()
+            err, rerr := d.Run(rollback)
+            results[i] = [2]error{ err, rerr }
+        }(i, rollback)
+    }
+    wg.Wait()
+
+    if rollbacks != 3 {
+        t.Errorf("%d rollbacks, want 3", rollbacks)
+    }
+    // Один запуск и один повторный после отката всех файлов
+    if n := runs(); n != 2 {
+        t.Errorf("command ran %d times, want 2", n)
+    }
+    for i, res := range results {
+        if res[0] == nil || res[1] == nil {
+            t.Errorf("waiter %d: Run() = %v, %v, want both errors", i, res[0], res[1])
+        }
+    }
+    if results[2][1] != broken {
+        t.Errorf("rollback error = %v, want %v", results[2][1], broken)
+    }
+}
@@ -1,14 +1,11 @@
 package config
 
 import (
-    "os"
     "log"
     "regexp"
-    "strings"
     "io/ioutil"
     "crypto/md5"
     "encoding/hex"
-    "gopkg.in/yaml.v2"
 )
 
 type Config struct {
@@ -21,6 +18,7 @@ type Global struct {
     CertFile       string                  `yaml:"cert_file"`
     CertKey        string                  `yaml:"cert_key"`
     Users          []UserInfo              `yaml:"users"`
+    AdminUsers     Users                   `yaml:"admin_users"`
 }
 
 //type GlobUsers map[string]string
@@ -43,6 +41,23 @@ type Backend struct {
     TrustedCaFile  string                  `yaml:"trusted_ca_file"`
     UseSSL         bool                    `yaml:"use_ssl"`
     Debug          bool                    `yaml:"debug"`
+    Health         Health                  `yaml:"health"`
+    Templates      Templates               `yaml:"templates"`
+}
+
+// Templates are the templates rendered by the server, kept
+// in a directory or under a key prefix of the backend.
+type Templates struct {
+    Dir            string                  `yaml:"dir"`
+    Prefix         string                  `yaml:"prefix"`
+}
+
+type Health struct {
+    Disabled       bool                    `yaml:"disabled"`
+    Interval       string                  `yaml:"interval"`
+    Timeout        string                  `yaml:"timeout"`
+    Path           string                  `yaml:"path"`
+    MaxNodes       int                     `yaml:"max_nodes"`
 }
 
 type Scheme struct {
@@ -81,19 +96,6 @@ type Action struct {
     Timestamp      int64                   `json:"timestamp"`
 }
 
-func getEnv(value string) string {
-    if len(value) > 0 && string(value[0]) == "$" {
-        val, ok := os.LookupEnv(strings.TrimPrefix(value, "$"))
-        if !ok {
-            log.Fatalf("[error] no value found for %v", value)
-            return ""
-        }
-        return val
-    }
-
-    return value
-}
-
 func getUser(cfg *Config, name string) (UserInfo, bool) {
     for _, info := range cfg.Global.Users {
         if info.Username == name {
@@ -125,53 +127,27 @@ func (u *Users) UnmarshalYAML(unmarshal func(interface{}) error) error {
     return nil
 }
 
+// LoadConfigFile reads and validates the configuration file.
+// Warnings are logged, errors are returned as *ConfigError.
 func LoadConfigFile(filename string) (*Config, error) {
-    cfg := &Config{}
-
     content, err := ioutil.ReadFile(filename)
     if err != nil {
-       return cfg, err
+       return &Config{}, err
     }
 
-    if err := yaml.UnmarshalStrict(content, cfg); err != nil {
-        return cfg, err
-    }
+    cfg, problems := CheckConfig(filename, content)
 
-    for u, usr := range cfg.Global.Users {
-        cfg.Global.Users[u].Username = getEnv(usr.Username)
-        cfg.Global.Users[u].Password = getEnv(usr.Password)
-    }
-
-    for b, backend := range cfg.Backends {
-        cfg.Backends[b].Read.Username = getEnv(backend.Read.Username)
-        cfg.Backends[b].Read.Password = getEnv(backend.Read.Password)
-        cfg.Backends[b].Write.Username = getEnv(backend.Write.Username)
-        cfg.Backends[b].Write.Password = getEnv(backend.Write.Password)
-
-        for method, _ := range backend.Checks {
-            for _, check := range backend.Checks[method] {
-                if check.Path != "" {
-                    re, err := regexp.Compile(check.Path)
-                    if err != nil {
-                        log.Fatalf("[error] %v", err)
-                    }
-                    check.RePath = re
-                }
-                if check.Regexp != "" {
-                    re, err := regexp.Compile(check.Regexp)
-                    if err != nil {
-                        log.Fatalf("[error] %v", err)
-                    }
-                    check.ReRegexp = re
-                }
-                for u, _ := range check.Users {
-                    if info, ok := getUser(cfg, u); ok {
-                        check.Users[u] = info
-                    }
-                }
-            }
+    failed := false
+    for _, p := range problems {
+        if p.Level == "error" {
+            failed = true
+            continue
         }
+        log.Printf("[warn] %v", p)
+    }
+    if failed {
+        return cfg, &ConfigError{Problems: problems}
     }
-    
+
     return cfg, nil
-}
\ No newline at end of file
+}
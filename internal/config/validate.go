@@ -0,0 +1,396 @@
+package config
+
+import (
+    "os"
+    "fmt"
+    "regexp"
+    "strings"
+    "strconv"
+    "sort"
+    "time"
+    "path/filepath"
+    "github.com/xeipuuv/gojsonschema"
+    "github.com/ltkh/confd/internal/secret"
+    "gopkg.in/yaml.v2"
+    yamlv3 "gopkg.in/yaml.v3"
+)
+
+var (
+    lineRegexp = regexp.MustCompile(`line (\d+)`)
+    backendTypes = map[string]bool{"etcd": true, "consul": true}
+    checkMethods = map[string]bool{"get": true, "put": true, "post": true, "delete": true}
+)
+
+// Problem describes an error or a warning found in the configuration file.
+type Problem struct {
+    File           string
+    Line           int
+    Column         int
+    Level          string
+    Message        string
+}
+
+func (p Problem) String() string {
+    return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Column, p.Level, p.Message)
+}
+
+// ConfigError is returned when the configuration file contains errors.
+type ConfigError struct {
+    Problems       []Problem
+}
+
+func (e *ConfigError) Error() string {
+    var msgs []string
+    for _, p := range e.Problems {
+        if p.Level == "error" {
+            msgs = append(msgs, p.String())
+        }
+    }
+    return strings.Join(msgs, "; ")
+}
+
+type checker struct {
+    file           string
+    root           *yamlv3.Node
+    problems       []Problem
+}
+
+func (c *checker) add(level, msg string, path ...interface{}) {
+    line, col := locate(c.root, path...)
+    c.problems = append(c.problems, Problem{File: c.file, Line: line, Column: col, Level: level, Message: msg})
+}
+
+func (c *checker) errorf(path []interface{}, format string, args ...interface{}) {
+    c.add("error", fmt.Sprintf(format, args...), path...)
+}
+
+func (c *checker) warnf(path []interface{}, format string, args ...interface{}) {
+    c.add("warning", fmt.Sprintf(format, args...), path...)
+}
+
+// addYamlError converts parser errors, which carry line numbers in the text.
+func (c *checker) addYamlError(err error) {
+    var msgs []string
+    if te, ok := err.(*yaml.TypeError); ok {
+        msgs = te.Errors
+    } else {
+        msgs = []string{err.Error()}
+    }
+    for _, msg := range msgs {
+        line := 0
+        if m := lineRegexp.FindStringSubmatch(msg); m != nil {
+            line, _ = strconv.Atoi(m[1])
+        }
+        c.problems = append(c.problems, Problem{File: c.file, Line: line, Level: "error", Message: msg})
+    }
+}
+
+// locate returns the position of the node addressed by the path of map keys
+// and sequence indexes, or of its nearest existing parent.
+func locate(node *yamlv3.Node, path ...interface{}) (int, int) {
+    if node == nil {
+        return 0, 0
+    }
+    if node.Kind == yamlv3.DocumentNode && len(node.Content) > 0 {
+        node = node.Content[0]
+    }
+
+    line, col := node.Line, node.Column
+
+    for _, p := range path {
+        var next *yamlv3.Node
+        switch key := p.(type) {
+            case string:
+                if node.Kind != yamlv3.MappingNode {
+                    return line, col
+                }
+                for i := 0; i+1 < len(node.Content); i += 2 {
+                    if node.Content[i].Value == key {
+                        // указываем на ключ, а дальше спускаемся по значению
+                        line, col = node.Content[i].Line, node.Content[i].Column
+                        next = node.Content[i+1]
+                        break
+                    }
+                }
+            case int:
+                if node.Kind != yamlv3.SequenceNode || key >= len(node.Content) {
+                    return line, col
+                }
+                next = node.Content[key]
+                line, col = next.Line, next.Column
+        }
+        if next == nil {
+            return line, col
+        }
+        node = next
+    }
+
+    return line, col
+}
+
+func path(p ...interface{}) []interface{} {
+    return p
+}
+
+func fileExists(name string) error {
+    _, err := os.Stat(name)
+    return err
+}
+
+// catchAll reports whether a rule matches every path.
+func catchAll(check *Scheme) bool {
+    if check.Pattern != "" {
+        return false
+    }
+    switch check.Path {
+        case "", ".*", "^.*", "^.*$", "^", ".*$":
+            return true
+    }
+    return false
+}
+
+func (c *checker) resolve(cfg *Config) {
+    var err error
+
+    for u, usr := range cfg.Global.Users {
+        if cfg.Global.Users[u].Username, err = secret.Resolve(usr.Username); err != nil {
+            c.errorf(path("global", "users", u, "username"), "%v", err)
+        }
+        if cfg.Global.Users[u].Password, err = secret.Resolve(usr.Password); err != nil {
+            c.errorf(path("global", "users", u, "password"), "%v", err)
+        }
+    }
+
+    if cfg.Global.CertFile, err = secret.ResolvePath(cfg.Global.CertFile); err != nil {
+        c.errorf(path("global", "cert_file"), "%v", err)
+    }
+    if cfg.Global.CertKey, err = secret.ResolvePath(cfg.Global.CertKey); err != nil {
+        c.errorf(path("global", "cert_key"), "%v", err)
+    }
+
+    for b, backend := range cfg.Backends {
+        if cfg.Backends[b].Read.Username, err = secret.Resolve(backend.Read.Username); err != nil {
+            c.errorf(path("backends", b, "read", "username"), "%v", err)
+        }
+        if cfg.Backends[b].Read.Password, err = secret.Resolve(backend.Read.Password); err != nil {
+            c.errorf(path("backends", b, "read", "password"), "%v", err)
+        }
+        if cfg.Backends[b].Write.Username, err = secret.Resolve(backend.Write.Username); err != nil {
+            c.errorf(path("backends", b, "write", "username"), "%v", err)
+        }
+        if cfg.Backends[b].Write.Password, err = secret.Resolve(backend.Write.Password); err != nil {
+            c.errorf(path("backends", b, "write", "password"), "%v", err)
+        }
+        if cfg.Backends[b].CertFile, err = secret.ResolvePath(backend.CertFile); err != nil {
+            c.errorf(path("backends", b, "cert_file"), "%v", err)
+        }
+        if cfg.Backends[b].CertKey, err = secret.ResolvePath(backend.CertKey); err != nil {
+            c.errorf(path("backends", b, "cert_key"), "%v", err)
+        }
+        if cfg.Backends[b].TrustedCaFile, err = secret.ResolvePath(backend.TrustedCaFile); err != nil {
+            c.errorf(path("backends", b, "trusted_ca_file"), "%v", err)
+        }
+    }
+}
+
+func (c *checker) checkUsers(cfg *Config, users Users, p []interface{}) {
+    for u, _ := range users {
+        if u == "" {
+            continue
+        }
+        info, ok := getUser(cfg, u)
+        if !ok {
+            c.errorf(p, "unknown user %q", u)
+            continue
+        }
+        users[u] = info
+    }
+}
+
+func (c *checker) validate(cfg *Config) {
+    names := map[string]int{}
+    for u, usr := range cfg.Global.Users {
+        if usr.Username == "" {
+            c.errorf(path("global", "users", u), "user without username")
+            continue
+        }
+        if prev, ok := names[usr.Username]; ok {
+            c.warnf(path("global", "users", u, "username"), "user %q is already defined (users[%d])", usr.Username, prev)
+            continue
+        }
+        names[usr.Username] = u
+    }
+
+    if (cfg.Global.CertFile == "") != (cfg.Global.CertKey == "") {
+        c.errorf(path("global"), "cert_file and cert_key must be set together")
+    }
+    if cfg.Global.CertFile != "" {
+        if err := fileExists(cfg.Global.CertFile); err != nil {
+            c.errorf(path("global", "cert_file"), "%v", err)
+        }
+    }
+    if cfg.Global.CertKey != "" {
+        if err := fileExists(cfg.Global.CertKey); err != nil {
+            c.errorf(path("global", "cert_key"), "%v", err)
+        }
+    }
+
+    c.checkUsers(cfg, cfg.Global.AdminUsers, path("global", "admin_users"))
+
+    ids := map[string]int{}
+    for b, backend := range cfg.Backends {
+        if backend.Id == "" {
+            c.errorf(path("backends", b), "backend without id")
+        } else if prev, ok := ids[backend.Id]; ok {
+            c.errorf(path("backends", b, "id"), "duplicate backend id %q (backends[%d])", backend.Id, prev)
+        } else {
+            ids[backend.Id] = b
+        }
+
+        if !backendTypes[backend.Backend] {
+            c.errorf(path("backends", b, "backend"), "unknown backend type %q", backend.Backend)
+        }
+
+        if len(backend.Nodes) == 0 {
+            c.errorf(path("backends", b, "nodes"), "no nodes defined")
+        }
+
+        if backend.UseSSL {
+            if backend.CertFile == "" || backend.CertKey == "" {
+                c.errorf(path("backends", b), "use_ssl requires cert_file and cert_key")
+            }
+            for _, f := range []struct{ key, name string }{
+                {"cert_file", backend.CertFile},
+                {"cert_key", backend.CertKey},
+                {"trusted_ca_file", backend.TrustedCaFile},
+            } {
+                if f.name == "" {
+                    continue
+                }
+                if err := fileExists(f.name); err != nil {
+                    c.errorf(path("backends", b, f.key), "%v", err)
+                }
+            }
+        }
+
+        for _, d := range []struct{ key, value string }{
+            {"interval", backend.Health.Interval},
+            {"timeout", backend.Health.Timeout},
+        } {
+            if d.value == "" {
+                continue
+            }
+            if _, err := time.ParseDuration(d.value); err != nil {
+                c.errorf(path("backends", b, "health", d.key), "%v", err)
+            }
+        }
+
+        if backend.Templates.Dir != "" || backend.Templates.Prefix != "" {
+            if backend.Backend != "etcd" {
+                c.errorf(path("backends", b, "templates"), "templates are supported by etcd backends only")
+            }
+            if backend.Templates.Dir != "" && backend.Templates.Prefix != "" {
+                c.errorf(path("backends", b, "templates"), "dir and prefix cannot be set together")
+            }
+            if backend.Templates.Dir != "" {
+                if info, err := os.Stat(backend.Templates.Dir); err != nil {
+                    c.errorf(path("backends", b, "templates", "dir"), "%v", err)
+                } else if !info.IsDir() {
+                    c.errorf(path("backends", b, "templates", "dir"), "%s is not a directory", backend.Templates.Dir)
+                }
+            }
+            if backend.Templates.Prefix != "" && !strings.HasPrefix(backend.Templates.Prefix, "/") {
+                c.errorf(path("backends", b, "templates", "prefix"), "prefix must start with /")
+            }
+        }
+
+        for method, checks := range backend.Checks {
+            if !checkMethods[method] {
+                c.errorf(path("backends", b, "checks", method), "unknown method %q", method)
+            }
+
+            shadowed := -1
+            paths := map[string]int{}
+
+            for i, check := range checks {
+                p := path("backends", b, "checks", method, i)
+
+                if shadowed >= 0 {
+                    c.warnf(p, "rule is unreachable, all paths are matched by %s[%d]", method, shadowed)
+                } else if prev, ok := paths[check.Path+"\x00"+check.Pattern]; ok && !check.Continue {
+                    c.warnf(p, "rule is unreachable, the same path is matched by %s[%d]", method, prev)
+                }
+
+                if check.Path != "" {
+                    re, err := regexp.Compile(check.Path)
+                    if err != nil {
+                        c.errorf(append(p, "path"), "%v", err)
+                    }
+                    check.RePath = re
+                }
+                if check.Pattern != "" {
+                    if _, err := filepath.Match(check.Pattern, ""); err != nil {
+                        c.errorf(append(p, "pattern"), "%v", err)
+                    }
+                }
+                if check.Regexp != "" {
+                    re, err := regexp.Compile(check.Regexp)
+                    if err != nil {
+                        c.errorf(append(p, "regexp"), "%v", err)
+                    }
+                    check.ReRegexp = re
+                }
+                if check.Schema != "" {
+                    loader := gojsonschema.NewReferenceLoader(check.Schema)
+                    if _, err := gojsonschema.NewSchema(loader); err != nil {
+                        c.errorf(append(p, "schema"), "invalid schema %q: %v", check.Schema, err)
+                    }
+                }
+                switch check.Dir {
+                    case "", "true", "false":
+                    default:
+                        c.errorf(append(p, "dir"), "dir must be \"true\" or \"false\"")
+                }
+
+                c.checkUsers(cfg, check.Users, append(p, "users"))
+
+                if !check.Continue {
+                    if _, ok := paths[check.Path+"\x00"+check.Pattern]; !ok {
+                        paths[check.Path+"\x00"+check.Pattern] = i
+                    }
+                    if shadowed < 0 && catchAll(check) {
+                        shadowed = i
+                    }
+                }
+            }
+        }
+    }
+}
+
+// CheckConfig parses and validates the configuration, collecting all
+// problems instead of stopping at the first one.
+func CheckConfig(filename string, content []byte) (*Config, []Problem) {
+    cfg := &Config{}
+    c := &checker{ file: filename }
+
+    var root yamlv3.Node
+    if err := yamlv3.Unmarshal(content, &root); err != nil {
+        c.addYamlError(err)
+        return cfg, c.problems
+    }
+    c.root = &root
+
+    if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+        c.addYamlError(err)
+        return cfg, c.problems
+    }
+
+    c.resolve(cfg)
+    c.validate(cfg)
+
+    sort.SliceStable(c.problems, func(i, j int) bool {
+        return c.problems[i].Line < c.problems[j].Line
+    })
+
+    return cfg, c.problems
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+    "strings"
+    "testing"
+)
+
+const validConfig = `global:
+  users:
+    - username: "reader"
+      password: "secret"
+  admin_users: ["reader"]
+backends:
+  - backend: "etcd"
+    id: "etcd"
+    nodes: ["http://127.0.0.1:2379"]
+    health:
+      interval: "30s"
+    checks:
+      get:
+        - path: "^/ps/"
+          users: ["reader"]
+        - path: ".*"
+      put:
+        - pattern: "/ps/*"
+          regexp: "^[a-z]+$"
+          dir: "false"
+`
+
+func TestCheckConfigValid(t *testing.T) {
+    cfg, problems := CheckConfig("config.yml", []byte(validConfig))
+    if len(problems) != 0 {
+        t.Fatalf("problems of a valid config: %v", problems)
+    }
+    if cfg.Global.AdminUsers["reader"].Password != "secret" {
+        t.Errorf("admin user is not resolved: %+v", cfg.Global.AdminUsers)
+    }
+    if cfg.Backends[0].Checks["get"][0].RePath == nil || cfg.Backends[0].Checks["put"][0].ReRegexp == nil {
+        t.Error("regexps of the checks are not compiled")
+    }
+}
+
+func TestCheckConfig(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        // file:line:col: level: message
+        want    string
+    }{
+        {
+            name:    "yaml syntax",
+            content: "backends:\n  - id: [\n",
+            want:    "config.yml:2:0: error: yaml: line 2",
+        },
+        {
+            name:    "unknown field",
+            content: "backends:\n  - id: \"a\"\n    nodez: []\n",
+            want:    "config.yml:3:0: error: line 3: field nodez not found",
+        },
+        {
+            name:    "duplicate id",
+            content: "backends:\n  - {backend: etcd, id: a, nodes: [n]}\n  - backend: etcd\n    id: a\n    nodes: [n]\n",
+            want:    `config.yml:4:5: error: duplicate backend id "a" (backends[0])`,
+        },
+        {
+            name:    "backend without id",
+            content: "backends:\n  - backend: etcd\n    nodes: [n]\n",
+            want:    "config.yml:2:5: error: backend without id",
+        },
+        {
+            name:    "unknown backend type",
+            content: "backends:\n  - id: a\n    backend: redis\n    nodes: [n]\n",
+            want:    `config.yml:3:5: error: unknown backend type "redis"`,
+        },
+        {
+            name:    "no nodes",
+            content: "backends:\n  - id: a\n    backend: etcd\n",
+            want:    "config.yml:2:5: error: no nodes defined",
+        },
+        {
+            name:    "bad duration",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    health:\n      timeout: 5\n",
+            want:    "config.yml:6:7: error: time: missing unit in duration",
+        },
+        {
+            name:    "bad path regexp",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n        - path: \"(\"\n",
+            want:    "config.yml:7:11: error: error parsing regexp: missing closing )",
+        },
+        {
+            name:    "bad value regexp",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      put:\n        - path: \"^/a\"\n          regexp: \"[\"\n",
+            want:    "config.yml:8:11: error: error parsing regexp: missing closing ]",
+        },
+        {
+            name:    "bad pattern",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n        - pattern: \"[\"\n",
+            want:    "config.yml:7:11: error: syntax error in pattern",
+        },
+        {
+            name:    "unknown method",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      patch:\n        - path: \"^/a\"\n",
+            want:    `config.yml:6:7: error: unknown method "patch"`,
+        },
+        {
+            name:    "bad dir",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      put:\n        - dir: \"yes\"\n",
+            want:    `config.yml:7:11: error: dir must be "true" or "false"`,
+        },
+        {
+            name:    "unknown user",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n        - path: \"^/a\"\n          users: [nobody]\n",
+            want:    `config.yml:8:11: error: unknown user "nobody"`,
+        },
+        {
+            name:    "unknown admin user",
+            content: "global:\n  admin_users: [root]\n",
+            want:    `config.yml:2:3: error: unknown user "root"`,
+        },
+        {
+            name:    "user without username",
+            content: "global:\n  users:\n    - password: x\n",
+            want:    "config.yml:3:7: error: user without username",
+        },
+        {
+            name:    "duplicate user",
+            content: "global:\n  users:\n    - username: a\n    - username: a\n",
+            want:    `config.yml:4:7: warning: user "a" is already defined (users[0])`,
+        },
+        {
+            name:    "cert without key",
+            content: "global:\n  cert_file: /nonexistent\n",
+            want:    "config.yml:1:1: error: cert_file and cert_key must be set together",
+        },
+        {
+            name:    "ssl without certs",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    use_ssl: true\n",
+            want:    "config.yml:2:5: error: use_ssl requires cert_file and cert_key",
+        },
+        {
+            name:    "templates of consul",
+            content: "backends:\n  - id: a\n    backend: consul\n    nodes: [n]\n    templates:\n      prefix: /t\n",
+            want:    "config.yml:5:5: error: templates are supported by etcd backends only",
+        },
+        {
+            name:    "templates prefix",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    templates:\n      prefix: t\n",
+            want:    "config.yml:6:7: error: prefix must start with /",
+        },
+        {
+            name:    "shadowed rule",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n        - path: \".*\"\n        - path: \"^/a\"\n",
+            want:    "config.yml:8:11: warning: rule is unreachable, all paths are matched by get[0]",
+        },
+        {
+            name:    "same path",
+            content: "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n        - path: \"^/a\"\n        - path: \"^/a\"\n",
+            want:    "config.yml:8:11: warning: rule is unreachable, the same path is matched by get[0]",
+        },
+        {
+            name:    "unresolved secret",
+            content: "global:\n  users:\n    - username: a\n      password: \"${CONFD_TEST_UNSET_VARIABLE}\"\n",
+            want:    "config.yml:4:7: error:",
+        },
+    }
+
+    for _, tt := range tests {
+        _, problems := CheckConfig("config.yml", []byte(tt.content))
+        found := false
+        for _, p := range problems {
+            if strings.HasPrefix(p.String(), tt.want) {
+                found = true
+            }
+        }
+        if !found {
+            t.Errorf("%s: problems = %q, want %q", tt.name, problems, tt.want)
+        }
+    }
+}
+
+func TestContinueNotShadowed(t *testing.T) {
+    content := "backends:\n  - id: a\n    backend: etcd\n    nodes: [n]\n    checks:\n      get:\n" +
+        "        - path: \".*\"\n          continue: true\n        - path: \"^/a\"\n"
+    if _, problems := CheckConfig("config.yml", []byte(content)); len(problems) != 0 {
+        t.Errorf("rule after a continue rule is reported: %v", problems)
+    }
+}
+
+func TestConfigError(t *testing.T) {
+    err := &ConfigError{Problems: []Problem{
+        {File: "c.yml", Line: 1, Column: 2, Level: "warning", Message: "w"},
+        {File: "c.yml", Line: 3, Column: 4, Level: "error", Message: "e"},
+    }}
+    if err.Error() != "c.yml:3:4: error: e" {
+        t.Errorf("Error() = %q, want only errors", err.Error())
+    }
+}
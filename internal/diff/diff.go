@@ -0,0 +1,36 @@
+package diff
+
+import (
+    "strings"
+    "github.com/pmezard/go-difflib/difflib"
+)
+
+// Unified returns the unified diff between the old and the new content,
+// or an empty string if they are equal. Use /dev/null as the name
+// of a missing file.
+func Unified(oldName, newName string, old, new []byte) (string, error) {
+    if string(old) == string(new) {
+        return "", nil
+    }
+
+    return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+        A:        splitLines(string(old)),
+        B:        splitLines(string(new)),
+        FromFile: oldName,
+        ToFile:   newName,
+        Context:  3,
+    })
+}
+
+// splitLines splits the text into lines ending with a newline.
+func splitLines(s string) []string {
+    if s == "" {
+        return nil
+    }
+    lines := strings.SplitAfter(s, "\n")
+    if lines[len(lines)-1] == "" {
+        return lines[:len(lines)-1]
+    }
+    lines[len(lines)-1] += "\n"
+    return lines
+}
@@ -0,0 +1,156 @@
+package file
+
+import (
+    "os"
+    "fmt"
+    "strconv"
+    "runtime"
+    "io/ioutil"
+    "path/filepath"
+)
+
+// Options describes the attributes of an installed file.
+// Unset values are taken from the existing destination file.
+type Options struct {
+    Mode           string
+    Owner          string
+    Group          string
+}
+
+// Attrs are the resolved file attributes, -1 keeps the current owner or group.
+type Attrs struct {
+    Mode           os.FileMode
+    Uid            int
+    Gid            int
+}
+
+// GetAttrs resolves the options against the existing destination file.
+func GetAttrs(dest string, opts Options) (Attrs, error) {
+    attrs := Attrs{ Mode: 0644, Uid: -1, Gid: -1 }
+
+    if info, err := os.Stat(dest); err == nil {
+        attrs.Mode = info.Mode().Perm()
+        attrs.Uid, attrs.Gid = fileOwner(info)
+    } else if !os.IsNotExist(err) {
+        return attrs, err
+    }
+
+    if opts.Mode != "" {
+        mode, err := strconv.ParseUint(opts.Mode, 8, 32)
+        if err != nil {
+            return attrs, fmt.Errorf("invalid mode %q: %v", opts.Mode, err)
+        }
+        attrs.Mode = os.FileMode(mode).Perm()
+    }
+
+    if opts.Owner != "" {
+        uid, err := lookupUser(opts.Owner)
+        if err != nil {
+            return attrs, err
+        }
+        attrs.Uid = uid
+    }
+
+    if opts.Group != "" {
+        gid, err := lookupGroup(opts.Group)
+        if err != nil {
+            return attrs, err
+        }
+        attrs.Gid = gid
+    }
+
+    return attrs, nil
+}
+
+// WriteTemp writes the data into a new temporary file next to dest
+// (or into temp, if set), syncs it to disk and applies the attributes.
+// It returns the name of the temporary file.
+func WriteTemp(dest, temp string, data []byte, attrs Attrs) (string, error) {
+    var f *os.File
+    var err error
+
+    if temp != "" {
+        // Переименование атомарно только в пределах каталога dest
+        if filepath.Dir(filepath.Clean(temp)) != filepath.Dir(filepath.Clean(dest)) {
+            return "", fmt.Errorf("temp file %s is not in the directory of %s", temp, dest)
+        }
+        f, err = os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, attrs.Mode)
+    } else {
+        f, err = ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+    }
+    if err != nil {
+        return "", err
+    }
+
+    name := f.Name()
+    fail := func(err error) (string, error) {
+        f.Close()
+        os.Remove(name)
+        return "", err
+    }
+
+    if _, err := f.Write(data); err != nil {
+        return fail(err)
+    }
+    if err := f.Sync(); err != nil {
+        return fail(err)
+    }
+    if err := f.Chmod(attrs.Mode); err != nil {
+        return fail(err)
+    }
+    if err := chown(f, attrs.Uid, attrs.Gid); err != nil {
+        return fail(err)
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(name)
+        return "", err
+    }
+
+    return name, nil
+}
+
+// Install atomically replaces dest with the temporary file.
+func Install(temp, dest string) error {
+    if err := os.Rename(temp, dest); err != nil {
+        return err
+    }
+
+    // Сохраняем на диск и саму запись в каталоге, в Windows каталог не синхронизируется
+    if runtime.GOOS == "windows" {
+        return nil
+    }
+    dir, err := os.Open(filepath.Dir(dest))
+    if err != nil {
+        return err
+    }
+    defer dir.Close()
+
+    return dir.Sync()
+}
+
+// Copy atomically replaces dest with a copy of src, keeping the mode
+// and owner of src.
+func Copy(src, dest string) error {
+    data, err := ioutil.ReadFile(src)
+    if err != nil {
+        return err
+    }
+
+    attrs := Attrs{ Mode: 0644, Uid: -1, Gid: -1 }
+    if info, err := os.Stat(src); err == nil {
+        attrs.Mode = info.Mode().Perm()
+        attrs.Uid, attrs.Gid = fileOwner(info)
+    }
+
+    temp, err := WriteTemp(dest, "", data, attrs)
+    if err != nil {
+        return err
+    }
+
+    if err := Install(temp, dest); err != nil {
+        os.Remove(temp)
+        return err
+    }
+
+    return nil
+}
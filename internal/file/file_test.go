@@ -0,0 +1,88 @@
+package file
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+func TestGetAttrs(t *testing.T) {
+    dir := t.TempDir()
+    dest := filepath.Join(dir, "dest")
+
+    attrs, err := GetAttrs(dest, Options{})
+    if err != nil || attrs.Mode != 0644 || attrs.Uid != -1 || attrs.Gid != -1 {
+        t.Errorf("GetAttrs(missing) = %+v, %v, want defaults", attrs, err)
+    }
+
+    ioutil.WriteFile(dest, []byte("old"), 0600)
+    os.Chmod(dest, 0600)
+    if attrs, err := GetAttrs(dest, Options{}); err != nil || attrs.Mode != 0600 {
+        t.Errorf("GetAttrs(existing) = %+v, %v, want mode 0600", attrs, err)
+    }
+    if attrs, err := GetAttrs(dest, Options{Mode: "0640"}); err != nil || attrs.Mode != 0640 {
+        t.Errorf("GetAttrs(mode 0640) = %+v, %v", attrs, err)
+    }
+    if _, err := GetAttrs(dest, Options{Mode: "rw"}); err == nil {
+        t.Error("invalid mode is accepted")
+    }
+}
+
+func TestWriteTempInstall(t *testing.T) {
+    dir := t.TempDir()
+    dest := filepath.Join(dir, "dest")
+    attrs := Attrs{Mode: 0640, Uid: -1, Gid: -1}
+
+    temp, err := WriteTemp(dest, "", []byte("new"), attrs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if filepath.Dir(temp) != dir {
+        t.Errorf("temp file %s is not next to dest", temp)
+    }
+    if err := Install(temp, dest); err != nil {
+        t.Fatal(err)
+    }
+
+    data, _ := ioutil.ReadFile(dest)
+    info, _ := os.Stat(dest)
+    if string(data) != "new" || info.Mode().Perm() != 0640 {
+        t.Errorf("dest = %q mode %v, want \"new\" mode 0640", data, info.Mode().Perm())
+    }
+    if _, err := os.Stat(temp); !os.IsNotExist(err) {
+        t.Errorf("temp file %s is left", temp)
+    }
+}
+
+func TestWriteTempOutsideDir(t *testing.T) {
+    dir := t.TempDir()
+    attrs := Attrs{Mode: 0644, Uid: -1, Gid: -1}
+
+    temp := filepath.Join(dir, ".dest.tmp")
+    if name, err := WriteTemp(filepath.Join(dir, "dest"), temp, []byte("x"), attrs); err != nil || name != temp {
+        t.Errorf("WriteTemp(temp in dir) = %q, %v", name, err)
+    }
+
+    other := filepath.Join(t.TempDir(), ".dest.tmp")
+    if _, err := WriteTemp(filepath.Join(dir, "dest"), other, []byte("x"), attrs); err == nil {
+        t.Error("temp file outside the directory of dest is accepted")
+    }
+}
+
+func TestCopy(t *testing.T) {
+    dir := t.TempDir()
+    src := filepath.Join(dir, "src")
+    ioutil.WriteFile(src, []byte("data"), 0600)
+    os.Chmod(src, 0600)
+
+    dest := filepath.Join(dir, "dest")
+    if err := Copy(src, dest); err != nil {
+        t.Fatal(err)
+    }
+    data, _ := ioutil.ReadFile(dest)
+    info, _ := os.Stat(dest)
+    if string(data) != "data" || info.Mode().Perm() != 0600 {
+        t.Errorf("copy = %q mode %v", data, info.Mode().Perm())
+    }
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+
+package file
+
+import (
+    "os"
+    "strconv"
+    "syscall"
+    "os/user"
+)
+
+func fileOwner(info os.FileInfo) (int, int) {
+    if st, ok := info.Sys().(*syscall.Stat_t); ok {
+        return int(st.Uid), int(st.Gid)
+    }
+    return -1, -1
+}
+
+func lookupUser(name string) (int, error) {
+    if id, err := strconv.Atoi(name); err == nil {
+        return id, nil
+    }
+    u, err := user.Lookup(name)
+    if err != nil {
+        return -1, err
+    }
+    return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+    if id, err := strconv.Atoi(name); err == nil {
+        return id, nil
+    }
+    g, err := user.LookupGroup(name)
+    if err != nil {
+        return -1, err
+    }
+    return strconv.Atoi(g.Gid)
+}
+
+func chown(f *os.File, uid, gid int) error {
+    if uid < 0 && gid < 0 {
+        return nil
+    }
+
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    // Не вызываем chown без необходимости, это требует прав
+    if cuid, cgid := fileOwner(info); (uid < 0 || uid == cuid) && (gid < 0 || gid == cgid) {
+        return nil
+    }
+
+    return f.Chown(uid, gid)
+}
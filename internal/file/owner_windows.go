@@ -0,0 +1,24 @@
+//go:build windows
+
+package file
+
+import (
+    "os"
+    "errors"
+)
+
+func fileOwner(info os.FileInfo) (int, int) {
+    return -1, -1
+}
+
+func lookupUser(name string) (int, error) {
+    return -1, errors.New("owner is not supported on windows")
+}
+
+func lookupGroup(name string) (int, error) {
+    return -1, errors.New("group is not supported on windows")
+}
+
+func chown(f *os.File, uid, gid int) error {
+    return nil
+}
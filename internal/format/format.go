@@ -0,0 +1,101 @@
+package format
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "strings"
+    "encoding/json"
+    "github.com/naoina/toml"
+    "gopkg.in/yaml.v3"
+)
+
+// Formats are the formats of rendered files that can be validated.
+var Formats = map[string]bool{"toml": true, "yaml": true, "json": true, "ini": true}
+
+// Validate returns the syntax error of the data in the format.
+func Validate(format string, data []byte) error {
+    switch format {
+        case "toml":
+            _, err := toml.Parse(data)
+            return err
+        case "yaml":
+            dec := yaml.NewDecoder(bytes.NewReader(data))
+            for {
+                var v interface{}
+                err := dec.Decode(&v)
+                if err == io.EOF {
+                    return nil
+                }
+                if err != nil {
+                    return err
+                }
+            }
+        case "json":
+            var v interface{}
+            if err := json.Unmarshal(data, &v); err != nil {
+                if e, ok := err.(*json.SyntaxError); ok {
+                    line, col := position(data, e.Offset)
+                    return fmt.Errorf("line %d, column %d: %v", line, col, err)
+                }
+                return err
+            }
+            return nil
+        case "ini":
+            return validateIni(data)
+    }
+    return fmt.Errorf("unknown format %q", format)
+}
+
+// position returns the line and column of the offset.
+func position(data []byte, offset int64) (int, int) {
+    if offset > int64(len(data)) {
+        offset = int64(len(data))
+    }
+    before := data[:offset]
+    line := bytes.Count(before, []byte("\n")) + 1
+    col := int(offset) - bytes.LastIndexByte(before, '\n') - 1
+    return line, col
+}
+
+// validateIni accepts comments (; or #), [section] headers and key = value
+// (or key: value) lines, quoted values must be closed.
+func validateIni(data []byte) error {
+    for i, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if strings.HasPrefix(line, "[") {
+            if !strings.HasSuffix(line, "]") || strings.TrimSpace(line[1:len(line)-1]) == "" {
+                return fmt.Errorf("line %d: invalid section %q", i+1, line)
+            }
+            continue
+        }
+        sep := strings.IndexAny(line, "=:")
+        if sep <= 0 {
+            return fmt.Errorf("line %d: expected key = value, got %q", i+1, line)
+        }
+        value := strings.TrimSpace(line[sep+1:])
+        if strings.HasPrefix(value, `"`) && !closed(value) {
+            return fmt.Errorf("line %d: unterminated quoted value", i+1)
+        }
+    }
+    return nil
+}
+
+// closed reports whether the quoted value ends with an unescaped quote.
+func closed(value string) bool {
+    escaped := false
+    for _, r := range value[1:] {
+        switch {
+            case escaped:
+                escaped = false
+            case r == '\\':
+                escaped = true
+            case r == '"':
+                return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,76 @@
+package format
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        format string
+        data   string
+        err    string
+    }{
+        {"toml", "[agent]\ninterval = \"10s\"\n[[inputs.cpu]]\n", ""},
+        {"toml", "[agent\ninterval = 1\n", "invalid TOML syntax"},
+        {"toml", "a = \"open\n", "invalid TOML syntax"},
+        {"yaml", "a: 1\nb:\n  - x\n", ""},
+        {"yaml", "a: 1\n---\nb: 2\n", ""},
+        {"yaml", "", ""},
+        {"yaml", "a: 1\n b: 2\n", "line 2"},
+        // Ошибка во втором документе тоже находится
+        {"yaml", "a: 1\n---\nb: [1\n", "line"},
+        {"json", `{"a": [1, 2]}`, ""},
+        {"json", "{\n  \"a\": 1,\n}", "line 3, column 1"},
+        {"json", `{"a": 1`, "unexpected end"},
+        {"ini", "; comment\n# comment\n[main]\nkey = value\nother: \"quoted \\\" value\"\n\n", ""},
+        {"ini", "[]\n", "line 1: invalid section"},
+        {"ini", "[main\n", "line 1: invalid section"},
+        {"ini", "[main]\njust text\n", "line 2: expected key = value"},
+        {"ini", "= value\n", "line 1: expected key = value"},
+        {"ini", "key = \"open\n", "line 1: unterminated quoted value"},
+        {"ini", "key = \"escaped \\\"\n", "line 1: unterminated quoted value"},
+        {"xml", "<a/>", "unknown format"},
+    }
+
+    for _, tt := range tests {
+        err := Validate(tt.format, []byte(tt.data))
+        switch {
+            case tt.err == "" && err != nil:
+                t.Errorf("%s %q: Validate() = %v, want nil", tt.format, tt.data, err)
+            case tt.err != "" && err == nil:
+                t.Errorf("%s %q: Validate() = nil, want %q", tt.format, tt.data, tt.err)
+            case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+                t.Errorf("%s %q: Validate() = %v, want %q", tt.format, tt.data, err, tt.err)
+        }
+    }
+}
+
+func TestFormats(t *testing.T) {
+    for f := range Formats {
+        if err := Validate(f, nil); err != nil && strings.Contains(err.Error(), "unknown format") {
+            t.Errorf("%s is listed but not validated", f)
+        }
+    }
+}
+
+func TestPosition(t *testing.T) {
+    data := []byte("ab\ncd\n")
+
+    tests := []struct {
+        offset    int64
+        line, col int
+    }{
+        {0, 1, 0},
+        {2, 1, 2},
+        {3, 2, 0},
+        {5, 2, 2},
+        {100, 3, 0},
+    }
+
+    for _, tt := range tests {
+        if line, col := position(data, tt.offset); line != tt.line || col != tt.col {
+            t.Errorf("position(%d) = %d, %d, want %d, %d", tt.offset, line, col, tt.line, tt.col)
+        }
+    }
+}
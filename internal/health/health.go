@@ -0,0 +1,362 @@
+package health
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/url"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+    "io/ioutil"
+    "crypto/tls"
+    "crypto/x509"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/ltkh/confd/internal/config"
+)
+
+var (
+    nodeUp = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdserver_backend_node_up",
+            Help: "Whether the last health check of the backend node succeeded",
+        },
+        []string{"backend", "node"},
+    )
+    nodeLatency = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdserver_backend_node_latency_seconds",
+            Help: "Latency of the last health check of the backend node",
+        },
+        []string{"backend", "node"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(nodeUp)
+    prometheus.MustRegister(nodeLatency)
+}
+
+type Result struct {
+    Address string
+    Latency time.Duration
+    Error   error
+}
+
+// Checker periodically probes the nodes of a backend and reports the
+// available ones, fastest first, to the OnUpdate callback.
+type Checker struct {
+    Id            string
+    Nodes         []string
+    Interval      time.Duration
+    Timeout       time.Duration
+    Path          string
+    MaxNodes      int
+    OnUpdate      func(nodes []string)
+    client        *http.Client
+    lock          sync.RWMutex
+    results       []Result
+    active        []string
+    stop          chan struct{}
+    stopOnce      sync.Once
+}
+
+func defaultPath(backend string) string {
+    switch backend {
+        case "etcd":
+            return "/health"
+        case "consul":
+            return "/v1/status/leader"
+    }
+    return ""
+}
+
+func NewChecker(backend config.Backend) (*Checker, error) {
+    interval := 30 * time.Second
+    if backend.Health.Interval != "" {
+        d, err := time.ParseDuration(backend.Health.Interval)
+        if err != nil {
+            return nil, err
+        }
+        interval = d
+    }
+
+    timeout := 5 * time.Second
+    if backend.Health.Timeout != "" {
+        d, err := time.ParseDuration(backend.Health.Timeout)
+        if err != nil {
+            return nil, err
+        }
+        timeout = d
+    }
+
+    path := backend.Health.Path
+    if path == "" {
+        path = defaultPath(backend.Backend)
+    }
+
+    for _, addr := range backend.Nodes {
+        if _, err := url.Parse(addr); err != nil {
+            return nil, err
+        }
+    }
+
+    // TLS настраивается так же, как у клиентов бэкенда
+    tlsConfig := &tls.Config{}
+    if backend.UseSSL {
+        if backend.TrustedCaFile != "" {
+            caCert, err := ioutil.ReadFile(backend.TrustedCaFile)
+            if err != nil {
+                return nil, err
+            }
+            caCertPool := x509.NewCertPool()
+            caCertPool.AppendCertsFromPEM(caCert)
+            tlsConfig.RootCAs = caCertPool
+        }
+        if backend.CertFile != "" && backend.CertKey != "" {
+            cert, err := tls.LoadX509KeyPair(backend.CertFile, backend.CertKey)
+            if err != nil {
+                return nil, err
+            }
+            tlsConfig.Certificates = []tls.Certificate{cert}
+        }
+    }
+
+    c := &Checker{
+        Id:        backend.Id,
+        Nodes:     backend.Nodes,
+        Interval:  interval,
+        Timeout:   timeout,
+        Path:      path,
+        MaxNodes:  backend.Health.MaxNodes,
+        client:    &http.Client{
+            Transport: &http.Transport{
+                TLSClientConfig: tlsConfig,
+            },
+            Timeout: timeout,
+        },
+        stop:      make(chan struct{}),
+    }
+
+    if backend.Health.Disabled {
+        c.Path = ""
+        c.Interval = 0
+    }
+
+    return c, nil
+}
+
+func (c *Checker) checkAddr(addr string, wg *sync.WaitGroup, results chan<- Result) {
+    defer wg.Done()
+
+    res := Result{ Address: addr }
+
+    u, err := url.Parse(addr)
+    if err != nil {
+        res.Error = err
+        results <- res
+        return
+    }
+
+    start := time.Now()
+    conn, err := net.DialTimeout("tcp", u.Host, c.Timeout)
+    res.Latency = time.Since(start)
+
+    if err != nil {
+        res.Error = err
+        results <- res
+        return
+    }
+    conn.Close()
+
+    if c.Path != "" {
+        resp, err := c.client.Get(addr + c.Path)
+        if err != nil {
+            res.Error = err
+            results <- res
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode != 200 {
+            res.Error = &StatusError{ Code: resp.StatusCode }
+        }
+    }
+
+    results <- res
+}
+
+// Check probes all nodes once and returns the results,
+// available nodes first ordered by latency, then the failed ones.
+func (c *Checker) Check() []Result {
+    resultsChan := make(chan Result, len(c.Nodes))
+    var wg sync.WaitGroup
+
+    // Запускаем проверки параллельно
+    for _, addr := range c.Nodes {
+        wg.Add(1)
+        go c.checkAddr(addr, &wg, resultsChan)
+    }
+
+    // Ждем завершения и закрываем канал
+    wg.Wait()
+    close(resultsChan)
+
+    var results []Result
+    for res := range resultsChan {
+        results = append(results, res)
+
+        up := 0.0
+        if res.Error == nil {
+            up = 1
+        }
+        nodeUp.WithLabelValues(c.Id, res.Address).Set(up)
+        nodeLatency.WithLabelValues(c.Id, res.Address).Set(res.Latency.Seconds())
+    }
+
+    // Сортируем: сначала рабочие по времени, затем — упавшие
+    sort.Slice(results, func(i, j int) bool {
+        if (results[i].Error == nil) != (results[j].Error == nil) {
+            return results[i].Error == nil
+        }
+        return results[i].Latency < results[j].Latency
+    })
+
+    c.lock.Lock()
+    c.results = results
+    c.lock.Unlock()
+
+    return results
+}
+
+// Available returns the nodes the clients should use: the healthy ones
+// (limited to MaxNodes), or all nodes in check order if none is healthy.
+func (c *Checker) Available(results []Result) []string {
+    var nodes []string
+    for _, res := range results {
+        if res.Error != nil {
+            continue
+        }
+        if c.MaxNodes > 0 && len(nodes) >= c.MaxNodes {
+            break
+        }
+        nodes = append(nodes, res.Address)
+    }
+
+    if len(nodes) == 0 {
+        for _, res := range results {
+            nodes = append(nodes, res.Address)
+        }
+    }
+
+    return nodes
+}
+
+// Results returns the results of the last check.
+func (c *Checker) Results() []Result {
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return c.results
+}
+
+func (c *Checker) update() {
+    c.apply(c.Check())
+}
+
+// apply reports the nodes of the check results to OnUpdate if they changed.
+func (c *Checker) apply(results []Result) {
+    nodes := c.Available(results)
+
+    for _, res := range results {
+        if res.Error != nil {
+            log.Printf("[warn] backend %v: node %v is down: %v", c.Id, res.Address, res.Error)
+        }
+    }
+
+    if equalNodes(c.active, nodes) {
+        return
+    }
+
+    log.Printf("[info] backend %v: active nodes %v", c.Id, nodes)
+    c.active = nodes
+
+    if c.OnUpdate != nil {
+        c.OnUpdate(nodes)
+    }
+}
+
+// Start runs the periodic health check in the background.
+func (c *Checker) Start() {
+    if c.Interval == 0 {
+        return
+    }
+
+    go func() {
+        ticker := time.NewTicker(c.Interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-c.stop:
+                return
+            case <-ticker.C:
+                c.update()
+            }
+        }
+    }()
+}
+
+// Stop terminates the background health check and removes the node metrics,
+// it can be called more than once.
+func (c *Checker) Stop() {
+    c.StopReplaced(nil)
+}
+
+// StopReplaced stops the checker replaced by next on reload, the metrics
+// of the nodes that next checks under the same id are kept.
+func (c *Checker) StopReplaced(next *Checker) {
+    c.stopOnce.Do(func() { close(c.stop) })
+
+    keep := map[string]bool{}
+    if next != nil && next.Id == c.Id {
+        for _, addr := range next.Nodes {
+            keep[addr] = true
+        }
+    }
+    for _, addr := range c.Nodes {
+        if keep[addr] {
+            continue
+        }
+        nodeUp.DeleteLabelValues(c.Id, addr)
+        nodeLatency.DeleteLabelValues(c.Id, addr)
+    }
+}
+
+// Init performs the first check synchronously and returns the nodes
+// the clients should be created with.
+func (c *Checker) Init() []string {
+    c.active = c.Available(c.Check())
+    return c.active
+}
+
+// equalNodes compares the node lists in order, the clients
+// are reconfigured when the fastest node changes.
+func equalNodes(a, b []string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+type StatusError struct {
+    Code int
+}
+
+func (e *StatusError) Error() string {
+    return fmt.Sprintf("health check returned status code: %d", e.Code)
+}
@@ -0,0 +1,140 @@
+package health
+
+import (
+    "errors"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "github.com/ltkh/confd/internal/config"
+)
+
+func TestEqualNodes(t *testing.T) {
+    tests := []struct {
+        a, b  []string
+        equal bool
+    }{
+        {nil, nil, true},
+        {[]string{"a", "b"}, []string{"a", "b"}, true},
+        {[]string{"a", "b"}, []string{"b", "a"}, false},
+        {[]string{"a"}, []string{"a", "b"}, false},
+        {[]string{"a", "b"}, []string{"a", "c"}, false},
+    }
+
+    for _, tt := range tests {
+        if got := equalNodes(tt.a, tt.b); got != tt.equal {
+            t.Errorf("equalNodes(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.equal)
+        }
+    }
+}
+
+func TestAvailable(t *testing.T) {
+    down := errors.New("down")
+    results := []Result{
+        {Address: "a"},
+        {Address: "b"},
+        {Address: "c", Error: down},
+    }
+
+    tests := []struct {
+        max     int
+        results []Result
+        nodes   []string
+    }{
+        {0, results, []string{"a", "b"}},
+        {1, results, []string{"a"}},
+        {0, []Result{{Address: "a", Error: down}, {Address: "b", Error: down}}, []string{"a", "b"}},
+    }
+
+    for _, tt := range tests {
+        c := &Checker{MaxNodes: tt.max}
+        if got := c.Available(tt.results); !equalNodes(got, tt.nodes) {
+            t.Errorf("Available(max %d) = %v, want %v", tt.max, got, tt.nodes)
+        }
+    }
+}
+
+func TestCheck(t *testing.T) {
+    up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer up.Close()
+    failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(500)
+    }))
+    defer failed.Close()
+
+    c, err := NewChecker(config.Backend{
+        Id:      "test",
+        Backend: "etcd",
+        Nodes:   []string{failed.URL, up.URL},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    results := c.Check()
+    if len(results) != 2 || results[0].Address != up.URL || results[0].Error != nil {
+        t.Fatalf("healthy node is not first: %+v", results)
+    }
+    var se *StatusError
+    if !errors.As(results[1].Error, &se) || se.Code != 500 {
+        t.Errorf("failed node error = %v, want status code 500", results[1].Error)
+    }
+}
+
+func TestApplyReordered(t *testing.T) {
+    var updates [][]string
+    c := &Checker{
+        Id:       "test",
+        OnUpdate: func(nodes []string) { updates = append(updates, nodes) },
+        active:   []string{"a", "b"},
+    }
+
+    c.apply([]Result{{Address: "a"}, {Address: "b"}})
+    if len(updates) != 0 {
+        t.Fatalf("unchanged nodes reported: %v", updates)
+    }
+
+    // Узел b стал быстрее
+    c.apply([]Result{{Address: "b"}, {Address: "a"}})
+    if len(updates) != 1 || !equalNodes(updates[0], []string{"b", "a"}) {
+        t.Fatalf("reordered nodes are not reported: %v", updates)
+    }
+}
+
+func TestStopTwice(t *testing.T) {
+    c, err := NewChecker(config.Backend{Id: "test", Backend: "etcd"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    c.Stop()
+    c.Stop()
+}
+
+func TestStopReplaced(t *testing.T) {
+    old, _ := NewChecker(config.Backend{Id: "replaced", Backend: "etcd", Nodes: []string{"http://a", "http://b"}})
+    next, _ := NewChecker(config.Backend{Id: "replaced", Backend: "etcd", Nodes: []string{"http://a"}})
+
+    // Новый бэкенд уже выполнил первую проверку
+    for _, addr := range old.Nodes {
+        nodeUp.WithLabelValues("replaced", addr).Set(1)
+    }
+    old.StopReplaced(next)
+
+    if !nodeUp.DeleteLabelValues("replaced", "http://a") {
+        t.Error("metric of the node checked by the new backend is deleted")
+    }
+    if nodeUp.DeleteLabelValues("replaced", "http://b") {
+        t.Error("metric of the removed node is kept")
+    }
+}
+
+func TestTrustedCaFile(t *testing.T) {
+    _, err := NewChecker(config.Backend{
+        Id:            "test",
+        Backend:       "etcd",
+        UseSSL:        true,
+        TrustedCaFile: "/nonexistent/ca.pem",
+    })
+    if err == nil {
+        t.Error("missing trusted_ca_file is not reported")
+    }
+}
@@ -0,0 +1,204 @@
+package merge
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    // Delete removes a key of the previous documents when used as its value,
+    // or an array element merged by key when set to true in it. null also
+    // removes a key, values of new keys are kept as is.
+    Delete = "$delete"
+)
+
+// Options describes how arrays are merged: "replace" (default), "append"
+// or "key:<field>" merging the elements with equal field values.
+type Options struct {
+    Arrays         string
+    // Rules are the strategies by dot separated path of the array, * matches any key.
+    // The most specific rule is used: a key is preferred to * from left to right.
+    Rules          map[string]string
+}
+
+// Validate checks the strategies of the options.
+func (o Options) Validate() error {
+    if err := checkStrategy(o.Arrays); err != nil {
+        return err
+    }
+    for path, s := range o.Rules {
+        if err := checkStrategy(s); err != nil {
+            return fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    return nil
+}
+
+func checkStrategy(s string) error {
+    switch {
+        case s == "", s == "replace", s == "append":
+            return nil
+        case strings.HasPrefix(s, "key:") && len(s) > len("key:"):
+            return nil
+    }
+    return fmt.Errorf("unknown array merge strategy %q", s)
+}
+
+// Merge deep-merges the documents in order, later ones override earlier ones.
+// Maps are merged by key, other values are replaced, nil documents are skipped.
+// The documents are not modified.
+func Merge(docs []interface{}, opts Options) (interface{}, error) {
+    if err := opts.Validate(); err != nil {
+        return nil, err
+    }
+
+    var out interface{}
+    for _, doc := range docs {
+        // Пустой документ (например, источник вернул 404) не стирает предыдущие
+        if doc == nil {
+            continue
+        }
+        out = merge(out, doc, "", opts)
+    }
+    return out, nil
+}
+
+func isDelete(v interface{}) bool {
+    return v == nil || v == Delete
+}
+
+func join(path, key string) string {
+    if path == "" {
+        return key
+    }
+    return path + "." + key
+}
+
+func match(pattern, path string) bool {
+    p := strings.Split(pattern, ".")
+    k := strings.Split(path, ".")
+    if len(p) != len(k) {
+        return false
+    }
+    for i := range p {
+        if p[i] != "*" && p[i] != k[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// moreSpecific reports whether the pattern a is more specific than b
+// of the same length: the first differing segment is a key in a and * in b.
+func moreSpecific(a, b string) bool {
+    p := strings.Split(a, ".")
+    q := strings.Split(b, ".")
+    for i := range p {
+        if (p[i] == "*") != (q[i] == "*") {
+            return q[i] == "*"
+        }
+    }
+    return false
+}
+
+func strategy(path string, opts Options) string {
+    if s, ok := opts.Rules[path]; ok {
+        return s
+    }
+    best := ""
+    for pattern := range opts.Rules {
+        if match(pattern, path) && (best == "" || moreSpecific(pattern, best)) {
+            best = pattern
+        }
+    }
+    if best != "" {
+        return opts.Rules[best]
+    }
+    if opts.Arrays == "" {
+        return "replace"
+    }
+    return opts.Arrays
+}
+
+// merge returns src merged into dst, new maps and arrays are created
+// instead of changing the existing ones.
+func merge(dst, src interface{}, path string, opts Options) interface{} {
+    switch s := src.(type) {
+        case map[string]interface{}:
+            out := map[string]interface{}{}
+            if d, ok := dst.(map[string]interface{}); ok {
+                for k, v := range d {
+                    out[k] = v
+                }
+            }
+            for k, v := range s {
+                // Маркер удаления элемента массива не попадает в результат
+                if _, ok := v.(bool); ok && k == Delete {
+                    continue
+                }
+                // null и "$delete" удаляют только ключи предыдущих документов
+                if _, ok := out[k]; ok && isDelete(v) {
+                    delete(out, k)
+                    continue
+                }
+                out[k] = merge(out[k], v, join(path, k), opts)
+            }
+            return out
+
+        case []interface{}:
+            d, _ := dst.([]interface{})
+            st := strategy(path, opts)
+
+            switch {
+                case st == "append":
+                    out := append([]interface{}{}, d...)
+                    for _, e := range s {
+                        out = append(out, merge(nil, e, path, opts))
+                    }
+                    return out
+
+                case strings.HasPrefix(st, "key:"):
+                    field := strings.TrimPrefix(st, "key:")
+                    out := append([]interface{}{}, d...)
+                    for _, e := range s {
+                        em, ok := e.(map[string]interface{})
+                        if !ok || em[field] == nil {
+                            out = append(out, merge(nil, e, path, opts))
+                            continue
+                        }
+                        i := indexOf(out, field, em[field])
+                        if em[Delete] == true {
+                            if i >= 0 {
+                                out = append(out[:i:i], out[i+1:]...)
+                            }
+                            continue
+                        }
+                        if i >= 0 {
+                            out[i] = merge(out[i], e, path, opts)
+                        } else {
+                            out = append(out, merge(nil, e, path, opts))
+                        }
+                    }
+                    return out
+
+                default:
+                    out := make([]interface{}, 0, len(s))
+                    for _, e := range s {
+                        out = append(out, merge(nil, e, path, opts))
+                    }
+                    return out
+            }
+    }
+
+    return src
+}
+
+// indexOf returns the index of the map element with the field value.
+func indexOf(list []interface{}, field string, value interface{}) int {
+    for i, e := range list {
+        if em, ok := e.(map[string]interface{}); ok && fmt.Sprint(em[field]) == fmt.Sprint(value) {
+            return i
+        }
+    }
+    return -1
+}
@@ -0,0 +1,164 @@
+package merge
+
+import (
+    "reflect"
+    "testing"
+    "encoding/json"
+)
+
+func doc(t *testing.T, s string) interface{} {
+    var v interface{}
+    if err := json.Unmarshal([]byte(s), &v); err != nil {
+        t.Fatal(err)
+    }
+    return v
+}
+
+func TestMerge(t *testing.T) {
+    tests := []struct {
+        name string
+        docs []string
+        opts Options
+        want string
+    }{
+        {
+            name: "maps",
+            docs: []string{`{"a":1,"b":{"c":1,"d":1}}`, `{"b":{"d":2,"e":2}}`},
+            want: `{"a":1,"b":{"c":1,"d":2,"e":2}}`,
+        },
+        {
+            // Источник с 404 не стирает предыдущие слои
+            name: "nil layer",
+            docs: []string{`{"a":1}`, `null`, `{"b":2}`, `null`},
+            want: `{"a":1,"b":2}`,
+        },
+        {
+            name: "only nil",
+            docs: []string{`null`},
+            want: `null`,
+        },
+        {
+            name: "delete",
+            docs: []string{`{"a":1,"b":2,"c":{"d":3}}`, `{"a":null,"c":"$delete"}`},
+            want: `{"b":2}`,
+        },
+        {
+            name: "replace",
+            docs: []string{`{"l":[1,2]}`, `{"l":[3]}`},
+            want: `{"l":[3]}`,
+        },
+        {
+            name: "append",
+            docs: []string{`{"l":[1,2]}`, `{"l":[3]}`},
+            opts: Options{Arrays: "append"},
+            want: `{"l":[1,2,3]}`,
+        },
+        {
+            name: "key",
+            docs: []string{
+                `{"l":[{"id":"a","v":1},{"id":"b","v":1},{"id":"c","v":1}]}`,
+                `{"l":[{"id":"b","v":2},{"id":"c","$delete":true},{"id":"d","v":3,"$delete":false},"x"]}`,
+            },
+            opts: Options{Arrays: "key:id"},
+            want: `{"l":[{"id":"a","v":1},{"id":"b","v":2},{"id":"d","v":3},"x"]}`,
+        },
+        {
+            name: "rules",
+            docs: []string{`{"a":{"l":[1]},"b":{"l":[1]},"c":[1]}`, `{"a":{"l":[2]},"b":{"l":[2]},"c":[2]}`},
+            opts: Options{Arrays: "replace", Rules: map[string]string{"*.l": "append"}},
+            want: `{"a":{"l":[1,2]},"b":{"l":[1,2]},"c":[2]}`,
+        },
+        {
+            name: "exact rule",
+            docs: []string{`{"a":{"l":[1]},"b":{"l":[1]}}`, `{"a":{"l":[2]},"b":{"l":[2]}}`},
+            opts: Options{Arrays: "append", Rules: map[string]string{"b.l": "replace"}},
+            want: `{"a":{"l":[1,2]},"b":{"l":[2]}}`,
+        },
+        {
+            // null и "$delete" без ключа в предыдущих документах сохраняются как значения
+            name: "null value",
+            docs: []string{`{"a":null,"b":{"c":null}}`, `{"b":{"d":"$delete"}}`},
+            want: `{"a":null,"b":{"c":null,"d":"$delete"}}`,
+        },
+        {
+            name: "delete null value",
+            docs: []string{`{"a":null,"b":1}`, `{"a":null}`},
+            want: `{"b":1}`,
+        },
+    }
+
+    for _, tt := range tests {
+        var docs []interface{}
+        for _, d := range tt.docs {
+            docs = append(docs, doc(t, d))
+        }
+        got, err := Merge(docs, tt.opts)
+        if err != nil {
+            t.Errorf("%s: Merge() error = %v", tt.name, err)
+            continue
+        }
+        if want := doc(t, tt.want); !reflect.DeepEqual(got, want) {
+            t.Errorf("%s: Merge() = %v, want %v", tt.name, got, want)
+        }
+    }
+}
+
+func TestMergeKeepsInput(t *testing.T) {
+    first := doc(t, `{"a":{"b":1},"l":[1]}`)
+    Merge([]interface{}{first, doc(t, `{"a":{"b":2},"l":[2]}`)}, Options{Arrays: "append"})
+
+    if want := doc(t, `{"a":{"b":1},"l":[1]}`); !reflect.DeepEqual(first, want) {
+        t.Errorf("input is modified: %v", first)
+    }
+}
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        opts Options
+        err  bool
+    }{
+        {Options{}, false},
+        {Options{Arrays: "key:id", Rules: map[string]string{"a": "append"}}, false},
+        {Options{Arrays: "key:"}, true},
+        {Options{Arrays: "merge"}, true},
+        {Options{Rules: map[string]string{"a": "unknown"}}, true},
+    }
+
+    for _, tt := range tests {
+        if err := tt.opts.Validate(); (err != nil) != tt.err {
+            t.Errorf("%+v: Validate() = %v, want error %v", tt.opts, err, tt.err)
+        }
+        if _, err := Merge(nil, tt.opts); (err != nil) != tt.err {
+            t.Errorf("%+v: Merge() = %v, want error %v", tt.opts, err, tt.err)
+        }
+    }
+}
+
+func TestOverlappingRules(t *testing.T) {
+    opts := Options{Arrays: "replace", Rules: map[string]string{
+        "*.*.l": "append",
+        "*.b.*": "key:id",
+        "a.*.*": "replace",
+        "x.*.l": "append",
+    }}
+
+    tests := []struct {
+        path string
+        want string
+    }{
+        {"a.b.l", "replace"},
+        {"c.b.l", "key:id"},
+        {"c.d.l", "append"},
+        {"x.b.l", "append"},
+        {"c.d.m", "replace"},
+    }
+
+    // Порядок обхода map не влияет на выбор правила
+    for i := 0; i < 100; i++ {
+        for _, tt := range tests {
+            if got := strategy(tt.path, opts); got != tt.want {
+                t.Fatalf("strategy(%q) = %q, want %q", tt.path, got, tt.want)
+            }
+        }
+    }
+}
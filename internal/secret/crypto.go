@@ -0,0 +1,150 @@
+package secret
+
+import (
+    "io"
+    "os"
+    "fmt"
+    "errors"
+    "strings"
+    "io/ioutil"
+    "crypto/aes"
+    "crypto/rand"
+    "crypto/cipher"
+    "crypto/sha256"
+    "encoding/base64"
+)
+
+var (
+    defaultKey *Key
+)
+
+// Key encrypts values with AES-256-GCM and a random nonce.
+type Key struct {
+    aead           cipher.AEAD
+}
+
+// NewKey derives the AES-256 key from any passphrase with SHA-256.
+func NewKey(passphrase []byte) (*Key, error) {
+    sum := sha256.Sum256(passphrase)
+
+    block, err := aes.NewCipher(sum[:])
+    if err != nil {
+        return nil, err
+    }
+
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+
+    return &Key{ aead: aead }, nil
+}
+
+// ReadKey reads the key from the file, or from the environment variable
+// when the file name is empty. It returns nil if neither is set.
+func ReadKey(file, env string) (*Key, error) {
+    if file != "" {
+        data, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, err
+        }
+        passphrase := strings.TrimSpace(string(data))
+        if passphrase == "" {
+            return nil, fmt.Errorf("key file %s is empty", file)
+        }
+        return NewKey([]byte(passphrase))
+    }
+
+    if val, ok := os.LookupEnv(env); ok && val != "" {
+        return NewKey([]byte(val))
+    }
+
+    return nil, nil
+}
+
+// GenerateKey returns a random passphrase suitable for a key file.
+func GenerateKey() (string, error) {
+    buf := make([]byte, 32)
+    if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// Seal encrypts the text and returns base64(nonce|ciphertext).
+func (k *Key) Seal(text string) (string, error) {
+    nonce := make([]byte, k.aead.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return "", err
+    }
+
+    data := k.aead.Seal(nonce, nonce, []byte(text), nil)
+    return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Open decrypts a value produced by Seal.
+func (k *Key) Open(value string) (string, error) {
+    data, err := base64.StdEncoding.DecodeString(value)
+    if err != nil {
+        return "", err
+    }
+    if len(data) < k.aead.NonceSize() {
+        return "", errors.New("encrypted value is too short")
+    }
+
+    text, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], nil)
+    if err != nil {
+        return "", fmt.Errorf("decrypting value: %v", err)
+    }
+
+    return string(text), nil
+}
+
+// LoadKey sets the key used for enc: values.
+func LoadKey(file, env string) error {
+    key, err := ReadKey(file, env)
+    if err != nil {
+        return err
+    }
+
+    lock.Lock()
+    defer lock.Unlock()
+    defaultKey = key
+
+    return nil
+}
+
+func getKey() (*Key, error) {
+    lock.RLock()
+    defer lock.RUnlock()
+
+    if defaultKey == nil {
+        return nil, errors.New("no secret key configured")
+    }
+    return defaultKey, nil
+}
+
+// Encrypt returns the enc: value for the text.
+func Encrypt(text string) (string, error) {
+    key, err := getKey()
+    if err != nil {
+        return "", err
+    }
+
+    value, err := key.Seal(text)
+    if err != nil {
+        return "", err
+    }
+
+    return "enc:" + value, nil
+}
+
+type encSource struct{}
+
+func (encSource) Lookup(ref string) (string, error) {
+    key, err := getKey()
+    if err != nil {
+        return "", err
+    }
+    return key.Open(ref)
+}
@@ -0,0 +1,115 @@
+package secret
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "strings"
+    "net/url"
+    "io/ioutil"
+)
+
+// Source resolves the reference part of a "<scheme>:<ref>" value.
+type Source interface {
+    Lookup(ref string) (string, error)
+}
+
+var (
+    lock    sync.RWMutex
+    sources = map[string]Source{
+        "env":  envSource{},
+        "file": fileSource{},
+        "enc":  encSource{},
+    }
+)
+
+// Register adds a secret source for the given scheme.
+func Register(scheme string, src Source) {
+    lock.Lock()
+    defer lock.Unlock()
+    sources[scheme] = src
+}
+
+func lookupSource(value string) (Source, string, bool) {
+    i := strings.Index(value, ":")
+    if i <= 0 {
+        return nil, "", false
+    }
+
+    lock.RLock()
+    src, ok := sources[value[:i]]
+    lock.RUnlock()
+
+    return src, value[i+1:], ok
+}
+
+// Resolve returns the secret referenced by the value:
+//   $NAME                  environment variable
+//   env:NAME[:-default]    environment variable with an optional default
+//   file:///path           contents of the file without the trailing newline
+//   enc:<base64>           value encrypted with the startup key
+// Values without a known scheme are returned as is.
+func Resolve(value string) (string, error) {
+    if strings.HasPrefix(value, "$") {
+        return envSource{}.Lookup(strings.TrimPrefix(value, "$"))
+    }
+
+    src, ref, ok := lookupSource(value)
+    if !ok {
+        return value, nil
+    }
+
+    return src.Lookup(ref)
+}
+
+// ResolvePath is Resolve for settings holding file names:
+// a file:// reference yields the file name instead of its contents.
+func ResolvePath(value string) (string, error) {
+    if strings.HasPrefix(value, "file:") {
+        return filePath(strings.TrimPrefix(value, "file:"))
+    }
+    return Resolve(value)
+}
+
+type envSource struct{}
+
+func (envSource) Lookup(ref string) (string, error) {
+    name, def, hasDef := strings.Cut(ref, ":-")
+
+    val, ok := os.LookupEnv(name)
+    if !ok {
+        if hasDef {
+            return def, nil
+        }
+        return "", fmt.Errorf("no value found for %v", name)
+    }
+
+    return val, nil
+}
+
+type fileSource struct{}
+
+func filePath(ref string) (string, error) {
+    u, err := url.Parse("file:" + ref)
+    if err != nil {
+        return "", err
+    }
+    if u.Path == "" {
+        return "", fmt.Errorf("invalid file reference %q", ref)
+    }
+    return u.Path, nil
+}
+
+func (fileSource) Lookup(ref string) (string, error) {
+    name, err := filePath(ref)
+    if err != nil {
+        return "", err
+    }
+
+    data, err := ioutil.ReadFile(name)
+    if err != nil {
+        return "", err
+    }
+
+    return strings.TrimRight(string(data), "\r\n"), nil
+}
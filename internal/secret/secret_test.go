@@ -0,0 +1,109 @@
+package secret
+
+import (
+    "os"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+func TestResolve(t *testing.T) {
+    os.Setenv("SECRET_TEST_VALUE", "from-env")
+    os.Unsetenv("SECRET_TEST_MISSING")
+
+    dir := t.TempDir()
+    name := filepath.Join(dir, "pw")
+    if err := ioutil.WriteFile(name, []byte("from-file\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        value string
+        want  string
+        err   bool
+    }{
+        {"plain", "plain", false},
+        {"http://host:80", "http://host:80", false},
+        {"$SECRET_TEST_VALUE", "from-env", false},
+        {"env:SECRET_TEST_VALUE", "from-env", false},
+        {"env:SECRET_TEST_MISSING:-default", "default", false},
+        {"env:SECRET_TEST_MISSING", "", true},
+        {"$SECRET_TEST_MISSING", "", true},
+        {"file://" + name, "from-file", false},
+        {"file://" + filepath.Join(dir, "missing"), "", true},
+    }
+
+    for _, tt := range tests {
+        got, err := Resolve(tt.value)
+        if (err != nil) != tt.err {
+            t.Errorf("Resolve(%q) error = %v, want error %v", tt.value, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("Resolve(%q) = %q, want %q", tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestResolvePath(t *testing.T) {
+    got, err := ResolvePath("file:///run/secrets/cert")
+    if err != nil || got != "/run/secrets/cert" {
+        t.Errorf("ResolvePath() = %q, %v, want the file name", got, err)
+    }
+}
+
+func TestSealOpen(t *testing.T) {
+    key, err := NewKey([]byte("passphrase"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := NewKey([]byte("other"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    value, err := key.Seal("secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    again, _ := key.Seal("secret")
+    if value == again {
+        t.Error("nonce is not random")
+    }
+
+    if text, err := key.Open(value); err != nil || text != "secret" {
+        t.Errorf("Open() = %q, %v, want secret", text, err)
+    }
+    if _, err := other.Open(value); err == nil {
+        t.Error("value is opened with another key")
+    }
+    if _, err := key.Open("c2hvcnQ="); err == nil {
+        t.Error("short value is opened")
+    }
+}
+
+func TestEncSource(t *testing.T) {
+    dir := t.TempDir()
+    name := filepath.Join(dir, "key")
+    if err := ioutil.WriteFile(name, []byte(" passphrase \n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := LoadKey(name, ""); err != nil {
+        t.Fatal(err)
+    }
+    defer LoadKey("", "SECRET_TEST_MISSING")
+
+    value, err := Encrypt("secret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if text, err := Resolve(value); err != nil || text != "secret" {
+        t.Errorf("Resolve(%q) = %q, %v, want secret", value, text, err)
+    }
+
+    empty := filepath.Join(dir, "empty")
+    ioutil.WriteFile(empty, []byte("\n"), 0600)
+    if _, err := ReadKey(empty, ""); err == nil {
+        t.Error("empty key file is accepted")
+    }
+}
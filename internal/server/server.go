@@ -0,0 +1,363 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "sync/atomic"
+    "strings"
+    "reflect"
+    "net/http"
+    "crypto/subtle"
+    "github.com/ltkh/confd/internal/api/v1"
+    "github.com/ltkh/confd/internal/api/v2"
+    "github.com/ltkh/confd/internal/config"
+    "github.com/ltkh/confd/internal/health"
+)
+
+// Server routes API requests to the configured backends and allows
+// the configuration to be replaced at runtime.
+type Server struct {
+    File           string
+    lock           sync.RWMutex
+    reload         sync.Mutex
+    config         *config.Config
+    backends       map[string]*Backend
+    draining       atomic.Bool
+}
+
+type Backend struct {
+    Config         config.Backend
+    Handler        http.Handler
+    Checker        *health.Checker
+    etcd           *v2.ApiEtcd
+}
+
+func New(file string) *Server {
+    return &Server{
+        File:     file,
+        backends: map[string]*Backend{},
+    }
+}
+
+// sameConnection reports whether two backend definitions can share
+// clients and cache, i.e. differ only in checks, debug and templates settings.
+func sameConnection(a, b config.Backend) bool {
+    a.Checks, b.Checks = nil, nil
+    a.Templates, b.Templates = config.Templates{}, config.Templates{}
+    a.Debug, b.Debug = false, false
+    return reflect.DeepEqual(a, b)
+}
+
+func newBackend(back config.Backend, logger config.Logger) (*Backend, error) {
+    checker, err := health.NewChecker(back)
+    if err != nil {
+        return nil, err
+    }
+
+    b := &Backend{ Config: back, Checker: checker }
+    back.Nodes = checker.Init()
+
+    switch back.Backend {
+        case "etcd":
+            etcdClient, err := v2.GetEtcdClient(back, logger)
+            if err != nil {
+                return nil, err
+            }
+            checker.OnUpdate = func(nodes []string) {
+                if err := etcdClient.SetNodes(nodes); err != nil {
+                    log.Printf("[error] %v", err)
+                }
+            }
+            b.Handler = etcdClient
+            b.etcd = etcdClient
+        case "consul":
+            consulClient, err := v1.GetConsulClient(back)
+            if err != nil {
+                return nil, err
+            }
+            consulApi := &v1.ApiConsul{Id: back.Id, Client: consulClient, Backend: back}
+            checker.OnUpdate = func(nodes []string) {
+                if err := consulApi.SetNodes(nodes); err != nil {
+                    log.Printf("[error] %v", err)
+                }
+            }
+            b.Handler = consulApi
+        default:
+            return nil, fmt.Errorf("unknown backend type %q for %q", back.Backend, back.Id)
+    }
+
+    return b, nil
+}
+
+func (b *Backend) start() {
+    b.Checker.Start()
+}
+
+// close stops the backend, next is the backend replacing it on reload, if any.
+func (b *Backend) close(next *Backend) {
+    if next != nil {
+        b.Checker.StopReplaced(next.Checker)
+    } else {
+        b.Checker.Stop()
+    }
+    if b.etcd != nil {
+        b.etcd.Close()
+    }
+}
+
+// Apply replaces the running configuration. Backends whose connection
+// settings are unchanged keep their clients and cache; on error the running
+// configuration is left untouched.
+func (s *Server) Apply(cfg *config.Config) error {
+    s.reload.Lock()
+    defer s.reload.Unlock()
+
+    if s.Draining() {
+        return fmt.Errorf("server is shutting down")
+    }
+
+    s.lock.RLock()
+    current := s.backends
+    s.lock.RUnlock()
+
+    ids := map[string]bool{}
+    for _, back := range cfg.Backends {
+        if ids[back.Id] {
+            return fmt.Errorf("duplicate backend id %q", back.Id)
+        }
+        ids[back.Id] = true
+    }
+
+    backends := map[string]*Backend{}
+    var created []*Backend
+
+    for _, back := range cfg.Backends {
+        if old, ok := current[back.Id]; ok && sameConnection(old.Config, back) {
+            backends[back.Id] = old
+            continue
+        }
+
+        b, err := newBackend(back, cfg.Logger)
+        if err != nil {
+            for _, c := range created {
+                c.close(nil)
+            }
+            return fmt.Errorf("backend %q: %v", back.Id, err)
+        }
+        backends[back.Id] = b
+        created = append(created, b)
+    }
+
+    // Обновляем настройки сохраненных бэкендов
+    for id, b := range backends {
+        if b.etcd == nil {
+            continue
+        }
+        for _, back := range cfg.Backends {
+            if back.Id == id {
+                b.etcd.SetBackend(&back)
+                break
+            }
+        }
+        b.etcd.SetLogger(cfg.Logger)
+    }
+
+    s.lock.Lock()
+    s.config = cfg
+    s.backends = backends
+    s.lock.Unlock()
+
+    for _, b := range created {
+        b.start()
+    }
+
+    for id, old := range current {
+        // Метрики узлов, которые проверяет новый бэкенд, не удаляются
+        if b := backends[id]; b != old {
+            old.close(b)
+        }
+    }
+
+    for id, _ := range backends {
+        if _, ok := current[id]; !ok {
+            log.Printf("[info] backend %q added", id)
+        }
+    }
+    for id, b := range current {
+        if backends[id] == nil {
+            log.Printf("[info] backend %q removed", id)
+        } else if backends[id] != b {
+            log.Printf("[info] backend %q recreated", id)
+        }
+    }
+
+    return nil
+}
+
+// Drain marks the server as not ready and interrupts wait requests.
+func (s *Server) Drain() {
+    s.draining.Store(true)
+
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+
+    for _, b := range s.backends {
+        if b.etcd != nil {
+            b.etcd.Drain()
+        }
+    }
+}
+
+// Draining reports whether the server is shutting down.
+func (s *Server) Draining() bool {
+    return s.draining.Load()
+}
+
+// Close stops all backends: health checks, cache watchers
+// and the delivery of pending actions.
+func (s *Server) Close() {
+    s.reload.Lock()
+    defer s.reload.Unlock()
+
+    s.lock.Lock()
+    backends := s.backends
+    s.backends = map[string]*Backend{}
+    s.lock.Unlock()
+
+    var wg sync.WaitGroup
+    for _, b := range backends {
+        wg.Add(1)
+        go func(b *Backend) {
+            defer wg.Done()
+            b.close(nil)
+        }(b)
+    }
+    wg.Wait()
+}
+
+// ReadyHandler reports whether the server accepts requests.
+func (s *Server) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain")
+
+    if s.Draining() {
+        w.WriteHeader(503)
+        w.Write([]byte("Draining"))
+        return
+    }
+
+    w.Write([]byte("OK"))
+}
+
+// Reload reads the configuration file again and applies it.
+func (s *Server) Reload() error {
+    cfg, err := config.LoadConfigFile(s.File)
+    if err != nil {
+        return err
+    }
+    return s.Apply(cfg)
+}
+
+// Config returns the running configuration.
+func (s *Server) Config() *config.Config {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return s.config
+}
+
+// Authorized reports whether the user may call the admin endpoints.
+func (s *Server) Authorized(user, pass string) bool {
+    cfg := s.Config()
+    if cfg == nil {
+        return false
+    }
+    usr, ok := cfg.Global.AdminUsers[user]
+    if !ok || usr.Username == "" {
+        return false
+    }
+    return subtle.ConstantTimeCompare([]byte(usr.Password), []byte(pass)) == 1
+}
+
+// ReloadHandler reloads the configuration on an authenticated POST request.
+func (s *Server) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain")
+
+    if r.Method != http.MethodPost {
+        w.WriteHeader(405)
+        return
+    }
+
+    user, pass, _ := r.BasicAuth()
+    if !s.Authorized(user, pass) {
+        log.Printf("[error] %s - %s \"%s %s\" 403 access is denied", r.RemoteAddr, user, r.Method, r.URL.Path)
+        w.WriteHeader(403)
+        w.Write([]byte("Access is denied"))
+        return
+    }
+
+    if err := s.Reload(); err != nil {
+        log.Printf("[error] reloading configuration file: %v", err)
+        w.WriteHeader(400)
+        w.Write([]byte(err.Error()))
+        return
+    }
+
+    log.Printf("[info] configuration reloaded by %s", user)
+    w.Write([]byte("OK"))
+}
+
+// RenderHandler serves /-/render/<id>/<template> by the etcd backend with the id,
+// the same as /api/v2/<id>/render/<template>.
+func (s *Server) RenderHandler(w http.ResponseWriter, r *http.Request) {
+    parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/-/render/"), "/", 2)
+    if len(parts) < 2 {
+        http.NotFound(w, r)
+        return
+    }
+
+    s.lock.RLock()
+    b, ok := s.backends[parts[0]]
+    s.lock.RUnlock()
+
+    if !ok || b.etcd == nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    b.etcd.ServeRender(w, r, parts[1])
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    // Новые запросы во время остановки повторяются клиентом позже
+    if s.Draining() {
+        w.Header().Set("Retry-After", "5")
+        w.WriteHeader(503)
+        return
+    }
+
+    // /api/<version>/<id>[/<path>]
+    parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/"), "/", 3)
+    if len(parts) < 2 {
+        http.NotFound(w, r)
+        return
+    }
+
+    s.lock.RLock()
+    b, ok := s.backends[parts[1]]
+    s.lock.RUnlock()
+
+    if !ok {
+        http.NotFound(w, r)
+        return
+    }
+
+    switch {
+        case parts[0] == "v2" && b.Config.Backend == "etcd":
+        case parts[0] == "v1" && b.Config.Backend == "consul":
+        default:
+            http.NotFound(w, r)
+            return
+    }
+
+    b.Handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+    "github.com/ltkh/confd/internal/config"
+)
+
+func backend(id, node string) config.Backend {
+    return config.Backend{
+        Backend: "etcd",
+        Id:      id,
+        Nodes:   []string{node},
+        Health:  config.Health{Disabled: true},
+    }
+}
+
+func TestApply(t *testing.T) {
+    s := New("")
+    defer s.Close()
+
+    cfg := &config.Config{Backends: []config.Backend{
+        backend("kept", "http://127.0.0.1:1"),
+        backend("recreated", "http://127.0.0.1:2"),
+        backend("removed", "http://127.0.0.1:3"),
+    }}
+    if err := s.Apply(cfg); err != nil {
+        t.Fatal(err)
+    }
+    before := map[string]*Backend{}
+    for id, b := range s.backends {
+        before[id] = b
+    }
+
+    // Изменение debug не пересоздает клиентов, изменение узлов - пересоздает
+    kept := backend("kept", "http://127.0.0.1:1")
+    kept.Debug = true
+    next := &config.Config{Backends: []config.Backend{
+        kept,
+        backend("recreated", "http://127.0.0.1:4"),
+        backend("added", "http://127.0.0.1:5"),
+    }}
+    if err := s.Apply(next); err != nil {
+        t.Fatal(err)
+    }
+
+    if s.backends["kept"] != before["kept"] {
+        t.Error("backend with the same connection is recreated")
+    }
+    if !s.backends["kept"].etcd.GetBackend().Debug {
+        t.Error("settings of the kept backend are not updated")
+    }
+    if b := s.backends["recreated"]; b == nil || b == before["recreated"] {
+        t.Error("backend with new nodes is not recreated")
+    }
+    if _, ok := s.backends["removed"]; ok {
+        t.Error("removed backend is still served")
+    }
+    if _, ok := s.backends["added"]; !ok {
+        t.Error("added backend is not served")
+    }
+    if s.Config() != next {
+        t.Error("configuration is not replaced")
+    }
+}
+
+func TestApplyRejected(t *testing.T) {
+    s := New("")
+    defer s.Close()
+
+    cfg := &config.Config{Backends: []config.Backend{backend("a", "http://127.0.0.1:1")}}
+    if err := s.Apply(cfg); err != nil {
+        t.Fatal(err)
+    }
+    running := s.backends["a"]
+
+    bad := backend("b", "http://127.0.0.1:2")
+    bad.Backend = "unknown"
+    tests := []*config.Config{
+        {Backends: []config.Backend{backend("a", "http://127.0.0.1:9"), backend("a", "http://127.0.0.1:9")}},
+        {Backends: []config.Backend{backend("a", "http://127.0.0.1:9"), bad}},
+    }
+
+    // Отклоненная конфигурация не меняет работающие бэкенды
+    for i, next := range tests {
+        if err := s.Apply(next); err == nil {
+            t.Errorf("config %d is accepted", i)
+        }
+        if s.Config() != cfg || len(s.backends) != 1 || s.backends["a"] != running {
+            t.Errorf("config %d changed the running state", i)
+        }
+    }
+
+    s.Drain()
+    if err := s.Apply(cfg); err == nil {
+        t.Error("config is applied while draining")
+    }
+}
+
+func TestServeHTTP(t *testing.T) {
+    s := New("")
+    defer s.Close()
+
+    if err := s.Apply(&config.Config{Backends: []config.Backend{backend("etcd", "http://127.0.0.1:1")}}); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, path := range []string{"/api/v2/missing/key", "/api/v1/etcd/key", "/api/v2"} {
+        w := httptest.NewRecorder()
+        s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+        if w.Code != http.StatusNotFound {
+            t.Errorf("GET %s = %d, want 404", path, w.Code)
+        }
+    }
+}
+
+func TestAuthorized(t *testing.T) {
+    s := New("")
+    if s.Authorized("admin", "secret") {
+        t.Error("authorized without configuration")
+    }
+
+    s.config = &config.Config{Global: config.Global{AdminUsers: config.Users{
+        "admin": {Username: "admin", Password: "secret"},
+        "empty": {Password: "secret"},
+    }}}
+
+    tests := []struct {
+        user, pass string
+        ok         bool
+    }{
+        {"admin", "secret", true},
+        {"admin", "secre", false},
+        {"admin", "", false},
+        {"empty", "secret", false},
+        {"other", "secret", false},
+    }
+    for _, tt := range tests {
+        if got := s.Authorized(tt.user, tt.pass); got != tt.ok {
+            t.Errorf("Authorized(%q, %q) = %v, want %v", tt.user, tt.pass, got, tt.ok)
+        }
+    }
+}
+
+func TestDrain(t *testing.T) {
+    s := New("")
+    defer s.Close()
+
+    if err := s.Apply(&config.Config{Backends: []config.Backend{backend("etcd", "http://127.0.0.1:1")}}); err != nil {
+        t.Fatal(err)
+    }
+
+    w := httptest.NewRecorder()
+    s.ReadyHandler(w, httptest.NewRequest("GET", "/-/ready", nil))
+    if w.Code != 200 {
+        t.Errorf("ready before Drain = %d, want 200", w.Code)
+    }
+
+    s.Drain()
+
+    w = httptest.NewRecorder()
+    s.ReadyHandler(w, httptest.NewRequest("GET", "/-/ready", nil))
+    if w.Code != 503 || w.Body.String() != "Draining" {
+        t.Errorf("ready after Drain = %d %q, want 503 Draining", w.Code, w.Body.String())
+    }
+
+    w = httptest.NewRecorder()
+    s.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/etcd/key", nil))
+    if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+        t.Errorf("request after Drain = %d, Retry-After %q, want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+    }
+}
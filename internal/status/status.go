@@ -0,0 +1,192 @@
+package status
+
+import (
+    "sort"
+    "sync"
+    "time"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    lastFetch = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdagent_template_last_fetch_timestamp_seconds",
+            Help: "Time of the last successful request of the template data",
+        },
+        []string{"template"},
+    )
+    lastReload = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdagent_template_last_reload_timestamp_seconds",
+            Help: "Time the template files were last installed and reloaded",
+        },
+        []string{"template"},
+    )
+    up = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdagent_template_up",
+            Help: "Whether the last run of the template succeeded",
+        },
+        []string{"template"},
+    )
+    cached = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Name: "cdagent_template_cached",
+            Help: "Whether the template is rendered from the cached response",
+        },
+        []string{"template"},
+    )
+    errorsTotal = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Name: "cdagent_template_errors_total",
+            Help: "Number of failed runs of the template",
+        },
+        []string{"template"},
+    )
+)
+
+func init() {
+    prometheus.MustRegister(lastFetch)
+    prometheus.MustRegister(lastReload)
+    prometheus.MustRegister(up)
+    prometheus.MustRegister(cached)
+    prometheus.MustRegister(errorsTotal)
+}
+
+// Template is the state of a template shown by the status API.
+type Template struct {
+    Name           string                 `json:"name"`
+    Src            string                 `json:"src"`
+    Dest           string                 `json:"dest"`
+    Path           string                 `json:"path"`
+    LastFetch      *time.Time             `json:"last_fetch,omitempty"`
+    LastHash       string                 `json:"last_hash,omitempty"`
+    LastError      string                 `json:"last_error,omitempty"`
+    LastReload     *time.Time             `json:"last_reload,omitempty"`
+    NextRun        *time.Time             `json:"next_run,omitempty"`
+    Cached         bool                   `json:"cached"`
+}
+
+type entry struct {
+    state          Template
+    sync           func()
+}
+
+// Registry keeps the states of the templates.
+type Registry struct {
+    lock           sync.RWMutex
+    templates      map[string]*entry
+}
+
+func NewRegistry() *Registry {
+    return &Registry{ templates: map[string]*entry{} }
+}
+
+// Add registers the template, sync forces its immediate run.
+func (r *Registry) Add(state Template, sync func()) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    r.templates[state.Name] = &entry{ state: state, sync: sync }
+    up.WithLabelValues(state.Name).Set(1)
+    cached.WithLabelValues(state.Name).Set(0)
+    errorsTotal.WithLabelValues(state.Name)
+}
+
+// Remove unregisters the template and its metrics.
+func (r *Registry) Remove(name string) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    delete(r.templates, name)
+    lastFetch.DeleteLabelValues(name)
+    lastReload.DeleteLabelValues(name)
+    up.DeleteLabelValues(name)
+    cached.DeleteLabelValues(name)
+    errorsTotal.DeleteLabelValues(name)
+}
+
+func (r *Registry) update(name string, fn func(*Template)) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    if e, ok := r.templates[name]; ok {
+        fn(&e.state)
+    }
+}
+
+// Fetched records a successful request, hash is empty if the data is not modified.
+func (r *Registry) Fetched(name, hash string) {
+    now := time.Now()
+    r.update(name, func(t *Template) {
+        t.LastFetch = &now
+        if hash != "" {
+            t.LastHash = hash
+        }
+    })
+    lastFetch.WithLabelValues(name).Set(float64(now.Unix()))
+}
+
+// Cached records whether the template is rendered from the cached response.
+func (r *Registry) Cached(name string, value bool) {
+    r.update(name, func(t *Template) {
+        t.Cached = value
+    })
+    if value {
+        cached.WithLabelValues(name).Set(1)
+    } else {
+        cached.WithLabelValues(name).Set(0)
+    }
+}
+
+// Reloaded records that the template files were installed and reloaded.
+func (r *Registry) Reloaded(name string) {
+    now := time.Now()
+    r.update(name, func(t *Template) {
+        t.LastReload = &now
+    })
+    lastReload.WithLabelValues(name).Set(float64(now.Unix()))
+}
+
+// Done records the result of a run and the time of the next one.
+func (r *Registry) Done(name string, err error, next time.Time) {
+    r.update(name, func(t *Template) {
+        t.LastError = ""
+        if err != nil {
+            t.LastError = err.Error()
+        }
+        t.NextRun = &next
+    })
+    if err != nil {
+        up.WithLabelValues(name).Set(0)
+        errorsTotal.WithLabelValues(name).Inc()
+    } else {
+        up.WithLabelValues(name).Set(1)
+    }
+}
+
+// Templates returns the states of all templates sorted by name.
+func (r *Registry) Templates() []Template {
+    r.lock.RLock()
+    defer r.lock.RUnlock()
+
+    list := make([]Template, 0, len(r.templates))
+    for _, e := range r.templates {
+        list = append(list, e.state)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+// Sync forces the immediate run of the template, false if it is unknown.
+func (r *Registry) Sync(name string) bool {
+    r.lock.RLock()
+    e, ok := r.templates[name]
+    r.lock.RUnlock()
+
+    if !ok {
+        return false
+    }
+    e.sync()
+    return true
+}
@@ -0,0 +1,72 @@
+package status
+
+import (
+    "time"
+    "errors"
+    "testing"
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+)
+
+func value(c prometheus.Collector, name string) float64 {
+    var m dto.Metric
+    var metric prometheus.Metric
+    switch v := c.(type) {
+        case *prometheus.GaugeVec:
+            metric = v.WithLabelValues(name)
+        case *prometheus.CounterVec:
+            metric = v.WithLabelValues(name)
+    }
+    metric.Write(&m)
+    if m.Gauge != nil {
+        return m.Gauge.GetValue()
+    }
+    return m.Counter.GetValue()
+}
+
+func TestRegistry(t *testing.T) {
+    r := NewRegistry()
+    synced := 0
+    r.Add(Template{Name: "b"}, func() { synced++ })
+    r.Add(Template{Name: "a"}, func() {})
+
+    r.Fetched("b", "h1")
+    r.Fetched("b", "")
+    r.Cached("b", true)
+    r.Reloaded("b")
+    next := time.Now().Add(time.Minute)
+    r.Done("b", errors.New("failed"), next)
+
+    list := r.Templates()
+    if len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+        t.Fatalf("Templates() = %+v, want a and b", list)
+    }
+    b := list[1]
+    if b.LastHash != "h1" || b.LastFetch == nil || b.LastReload == nil || !b.Cached {
+        t.Errorf("state = %+v", b)
+    }
+    if b.LastError != "failed" || b.NextRun == nil || !b.NextRun.Equal(next) {
+        t.Errorf("state after failure = %+v", b)
+    }
+    if value(up, "b") != 0 || value(errorsTotal, "b") != 1 || value(cached, "b") != 1 {
+        t.Errorf("metrics: up %v, errors %v, cached %v", value(up, "b"), value(errorsTotal, "b"), value(cached, "b"))
+    }
+
+    r.Done("b", nil, next)
+    if s := r.Templates()[1]; s.LastError != "" || value(up, "b") != 1 {
+        t.Errorf("state after success = %+v", s)
+    }
+
+    if !r.Sync("b") || synced != 1 {
+        t.Error("Sync(b) did not run the template")
+    }
+    if r.Sync("missing") {
+        t.Error("Sync(missing) = true")
+    }
+
+    r.Remove("b")
+    r.Fetched("b", "h2")
+    if list := r.Templates(); len(list) != 1 {
+        t.Errorf("Templates() after Remove = %+v", list)
+    }
+}
@@ -0,0 +1,55 @@
+// Package template renders configuration files with text/template.
+//
+// Numbers are coerced: ints, floats and numeric strings are accepted by all
+// numeric functions, results are int64 when integral and float64 otherwise.
+// Collection arguments come last, so that functions can be piped.
+//
+// Numbers
+//
+//     add, sub, mul A B        arithmetic: {{ add .port 1 }}
+//     div, mod A B             integer division and remainder if both operands
+//                              are integral: {{ div 7 2 }} is 3, {{ div 7 2.5 }} is 2.8
+//     toInt, toFloat V         conversion, also of strings; integers keep
+//                              their precision, floats are only used for
+//                              fractions and results out of the int64 range
+//
+// Values and collections
+//
+//     default DEF V            V, or DEF if V is nil, false, 0 or empty: {{ .port | default 80 }}
+//     empty V                  whether V is nil, false, 0 or empty
+//     keys MAP                 sorted keys
+//     values MAP               values sorted by key
+//     dict K V ...             new map: {{ dict "a" 1 "b" 2 }}
+//     list V ...               new list
+//     get PATH V               value by dot separated path (map keys, list
+//                              indexes), nil if not found: {{ get "a.b.0" . }}
+//     has PATH MAP             whether the map has the path
+//     has ELEM LIST            whether the list has the element
+//     uniq LIST                list without duplicates, in order
+//     sortAlpha LIST           elements as sorted strings
+//     sortByPath PATH LIST     maps sorted by the value at path as a string,
+//     sortByPathDesc PATH LIST in descending order
+//     sortByPathNum, sortByPathNumDesc PATH LIST
+//                              the same, numbers are compared numerically
+//                              and go before other values
+//     join SEP LIST            elements of any list joined
+//
+// Strings and encoding
+//
+//     trim S, trimAll S CUTSET, trimPrefix S PREFIX, trimSuffix S SUFFIX
+//     indent N S, nindent N S  every line prefixed with N spaces, nindent
+//                              adds a leading newline: {{ toYaml .x | nindent 2 }}
+//     b64enc S, b64dec S       standard base64
+//     sha256 S                 hex digest
+//     toJson V, toYaml V       JSON (tab indented) and YAML (2 spaces)
+//     toJsonCompact V          JSON on one line: "name": {{ .name | toJsonCompact }}
+//     toToml MAP               TOML document, nulls are not supported
+//     toTomlValue V            inline TOML value: urls = {{ .urls | toTomlValue }}
+//     toIni MAP                INI document, a section per nested map (dotted
+//                              names for deeper ones), lists are repeated keys
+//     ipInCIDR CIDR IP         whether IP belongs to the network
+//
+// Functions depending on the environment belong to groups enabled by the
+// Policy: network (connectHttp, requestHttp), dns (lookupIPV4, lookupIPV6),
+// file (fileExist), host (hostname, env) and time (datetime).
+package template
@@ -0,0 +1,327 @@
+package template
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "regexp"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+var (
+    bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// toToml encodes the map as a TOML document: plain values first,
+// then tables and arrays of tables, keys are sorted.
+func toToml(v interface{}) (string, error) {
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return "", fmt.Errorf("toToml: %T is not a map", v)
+    }
+
+    var b strings.Builder
+    if err := writeTomlTable(&b, nil, m); err != nil {
+        return "", fmt.Errorf("toToml: %v", err)
+    }
+    return strings.TrimSpace(b.String()), nil
+}
+
+func tomlKey(k string) string {
+    if bareKey.MatchString(k) {
+        return k
+    }
+    return tomlString(k)
+}
+
+func tomlPath(path []string) string {
+    keys := make([]string, len(path))
+    for i, k := range path {
+        keys[i] = tomlKey(k)
+    }
+    return strings.Join(keys, ".")
+}
+
+// isTables reports whether the value is a non-empty array of maps.
+func isTables(v interface{}) ([]interface{}, bool) {
+    list, ok := v.([]interface{})
+    if !ok || len(list) == 0 {
+        return nil, false
+    }
+    for _, e := range list {
+        if _, ok := e.(map[string]interface{}); !ok {
+            return nil, false
+        }
+    }
+    return list, true
+}
+
+// hasValues reports whether the table has values other than tables.
+func hasValues(m map[string]interface{}) bool {
+    for _, v := range m {
+        if _, ok := v.(map[string]interface{}); ok {
+            continue
+        }
+        if _, ok := isTables(v); ok {
+            continue
+        }
+        return true
+    }
+    return false
+}
+
+func writeTomlTable(b *strings.Builder, path []string, m map[string]interface{}) error {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        v := m[k]
+        if _, ok := v.(map[string]interface{}); ok {
+            continue
+        }
+        if _, ok := isTables(v); ok {
+            continue
+        }
+        value, err := tomlValue(v)
+        if err != nil {
+            return fmt.Errorf("%s: %v", tomlPath(append(path, k)), err)
+        }
+        fmt.Fprintf(b, "%s = %s\n", tomlKey(k), value)
+    }
+
+    for _, k := range keys {
+        sub := append(append([]string{}, path...), k)
+        switch v := m[k].(type) {
+            case map[string]interface{}:
+                // Заголовок таблицы только с вложенными таблицами не нужен
+                if len(v) == 0 || hasValues(v) {
+                    fmt.Fprintf(b, "\n[%s]\n", tomlPath(sub))
+                }
+                if err := writeTomlTable(b, sub, v); err != nil {
+                    return err
+                }
+            case []interface{}:
+                tables, ok := isTables(v)
+                if !ok {
+                    continue
+                }
+                for _, t := range tables {
+                    fmt.Fprintf(b, "\n[[%s]]\n", tomlPath(sub))
+                    if err := writeTomlTable(b, sub, t.(map[string]interface{})); err != nil {
+                        return err
+                    }
+                }
+        }
+    }
+
+    return nil
+}
+
+func tomlString(s string) string {
+    var b strings.Builder
+    b.WriteByte('"')
+    for _, r := range s {
+        switch r {
+            case '"':
+                b.WriteString(`\"`)
+            case '\\':
+                b.WriteString(`\\`)
+            case '\b':
+                b.WriteString(`\b`)
+            case '\t':
+                b.WriteString(`\t`)
+            case '\n':
+                b.WriteString(`\n`)
+            case '\f':
+                b.WriteString(`\f`)
+            case '\r':
+                b.WriteString(`\r`)
+            default:
+                if r < 0x20 || r == 0x7f {
+                    fmt.Fprintf(&b, `\u%04X`, r)
+                } else {
+                    b.WriteRune(r)
+                }
+        }
+    }
+    b.WriteByte('"')
+    return b.String()
+}
+
+// tomlValue encodes a value inline, maps in arrays become inline tables.
+func tomlValue(v interface{}) (string, error) {
+    switch val := v.(type) {
+        case nil:
+            return "", fmt.Errorf("null values are not supported")
+        case string:
+            return tomlString(val), nil
+        case bool:
+            return strconv.FormatBool(val), nil
+        case map[string]interface{}:
+            keys := make([]string, 0, len(val))
+            for k := range val {
+                keys = append(keys, k)
+            }
+            sort.Strings(keys)
+            parts := make([]string, 0, len(keys))
+            for _, k := range keys {
+                s, err := tomlValue(val[k])
+                if err != nil {
+                    return "", err
+                }
+                parts = append(parts, tomlKey(k)+" = "+s)
+            }
+            return "{" + strings.Join(parts, ", ") + "}", nil
+    }
+
+    if f, err := toNumber(v); err == nil {
+        switch {
+            case math.IsNaN(f):
+                return "nan", nil
+            case math.IsInf(f, 1):
+                return "inf", nil
+            case math.IsInf(f, -1):
+                return "-inf", nil
+            case isIntegral(f):
+                return strconv.FormatInt(int64(f), 10), nil
+        }
+        return strconv.FormatFloat(f, 'g', -1, 64), nil
+    }
+
+    if list, err := toList(v); err == nil {
+        parts := make([]string, 0, len(list))
+        for _, e := range list {
+            s, err := tomlValue(e)
+            if err != nil {
+                return "", err
+            }
+            parts = append(parts, s)
+        }
+        return "[" + strings.Join(parts, ", ") + "]", nil
+    }
+
+    return "", fmt.Errorf("unsupported type %T", v)
+}
+
+// toTomlValue encodes the value as an inline TOML value: {{ .urls | toTomlValue }}.
+func toTomlValue(v interface{}) (string, error) {
+    s, err := tomlValue(v)
+    if err != nil {
+        return "", fmt.Errorf("toTomlValue: %v", err)
+    }
+    return s, nil
+}
+
+// iniValue quotes the value if it has spaces at the ends or
+// characters with a special meaning, escaping them with \.
+func iniValue(v interface{}) (string, error) {
+    var s string
+    switch val := v.(type) {
+        case nil:
+            return "", nil
+        case string:
+            s = val
+        case bool:
+            s = strconv.FormatBool(val)
+        case map[string]interface{}, []interface{}:
+            return "", fmt.Errorf("unsupported type %T", v)
+        default:
+            f, err := toNumber(v)
+            if err != nil {
+                return "", fmt.Errorf("unsupported type %T", v)
+            }
+            if isIntegral(f) {
+                return strconv.FormatInt(int64(f), 10), nil
+            }
+            return strconv.FormatFloat(f, 'g', -1, 64), nil
+    }
+
+    if s == strings.TrimSpace(s) && !strings.ContainsAny(s, "\"\\;#=\n\r\t") {
+        return s, nil
+    }
+    r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+    return `"` + r.Replace(s) + `"`, nil
+}
+
+func writeIniKeys(b *strings.Builder, section string, m map[string]interface{}, keys []string) error {
+    for _, k := range keys {
+        if strings.ContainsAny(k, "=[]\n\r;#") || strings.TrimSpace(k) != k || k == "" {
+            return fmt.Errorf("invalid key %q", strings.TrimPrefix(section+"."+k, "."))
+        }
+        values := []interface{}{ m[k] }
+        if list, ok := m[k].([]interface{}); ok {
+            values = list
+        }
+        for _, v := range values {
+            s, err := iniValue(v)
+            if err != nil {
+                return fmt.Errorf("%s: %v", strings.TrimPrefix(section+"."+k, "."), err)
+            }
+            fmt.Fprintf(b, "%s = %s\n", k, s)
+        }
+    }
+    return nil
+}
+
+// toIni encodes the map as an INI document: plain values first, then a section
+// per nested map (dotted names for deeper maps), list values are repeated keys.
+func toIni(v interface{}) (string, error) {
+    m, ok := v.(map[string]interface{})
+    if !ok {
+        return "", fmt.Errorf("toIni: %T is not a map", v)
+    }
+
+    var b strings.Builder
+    if err := writeIniSection(&b, "", m); err != nil {
+        return "", fmt.Errorf("toIni: %v", err)
+    }
+    return strings.TrimSpace(b.String()), nil
+}
+
+func writeIniSection(b *strings.Builder, section string, m map[string]interface{}) error {
+    var plain, sections []string
+    for k, v := range m {
+        if _, ok := v.(map[string]interface{}); ok {
+            sections = append(sections, k)
+        } else {
+            plain = append(plain, k)
+        }
+    }
+    sort.Strings(plain)
+    sort.Strings(sections)
+
+    if section != "" && len(plain) > 0 {
+        fmt.Fprintf(b, "\n[%s]\n", section)
+    }
+    if err := writeIniKeys(b, section, m, plain); err != nil {
+        return err
+    }
+
+    for _, k := range sections {
+        if strings.ContainsAny(k, "[]\n\r") || k == "" {
+            return fmt.Errorf("invalid section %q", k)
+        }
+        name := k
+        if section != "" {
+            name = section + "." + k
+        }
+        if err := writeIniSection(b, name, m[k].(map[string]interface{})); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// toJsonCompact encodes the value as JSON on one line: "name": {{ .name | toJsonCompact }}.
+func toJsonCompact(v interface{}) (string, error) {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
@@ -2,17 +2,13 @@ package template
 
 import (
     "fmt"
+    "math"
     "reflect"
     "regexp"
     "strconv"
     "strings"
-    "net/http"
-    "time"
-    "net"
     "sort"
     "os"
-    "io/ioutil"
-    "bytes"
     //"errors"
     "encoding/json"
 )
@@ -36,29 +32,21 @@ func isSlice(v interface{}) bool {
 }
 
 func toInt(i interface{}) (int64, error) {
-    iv := reflect.ValueOf(i)
-    
-    switch iv.Kind() {
-        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-            return iv.Int(), nil
-        case reflect.Float32, reflect.Float64:
-            return int64(iv.Float()), nil
+    if n, ok := integer(i); ok {
+        return n, nil
     }
-
-    return 0, fmt.Errorf("unknown type - %T", i)    
+    f, err := toNumber(i)
+    if err != nil {
+        return 0, err
+    }
+    if math.IsNaN(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+        return 0, fmt.Errorf("%v is out of the int64 range", i)
+    }
+    return int64(f), nil
 }
 
 func toFloat(i interface{}) (float64, error) {
-    iv := reflect.ValueOf(i)
-    
-    switch iv.Kind() {
-        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-            return float64(iv.Int()), nil
-        case reflect.Float32, reflect.Float64:
-            return iv.Float(), nil    
-    }
-
-    return 0, fmt.Errorf("unknown type - %T", i)
+    return toNumber(i)
 }
 
 func toString(data interface{}) (string, error) {
@@ -74,34 +62,6 @@ func toJson(data interface{}) (string, error) {
     return string(result), nil
 }
 
-func addFunc(b, a interface{}) (float64, error) {
-    av := reflect.ValueOf(a)
-    bv := reflect.ValueOf(b)
-
-    switch av.Kind() {
-        case reflect.Int:
-            switch bv.Kind() {
-                case reflect.Int:
-                    return float64(av.Int() + bv.Int()), nil
-                case reflect.Float64:
-                    return float64(av.Int()) + bv.Float(), nil
-                default:
-                    return 0, fmt.Errorf("unknown type - %T", b)
-            }
-        case reflect.Float64:
-            switch bv.Kind() {
-                case reflect.Int:
-                    return av.Float() + float64(bv.Int()), nil
-                case reflect.Float64:
-                    return av.Float() + bv.Float(), nil
-                default:
-                    return 0, fmt.Errorf("unknown type - %T", b)
-            }
-        default:
-            return 0, fmt.Errorf("unknown type - %T", a)
-    }
-}
-
 func strQuote(data string) (string, error) {
     s := strconv.Quote(data)
     return s[1:len(s)-1], nil
@@ -124,63 +84,6 @@ func pushToArray(arr []interface{}, vl interface{}) []interface{} {
     return append(arr, vl)
 }
 
-func connectHttpFunc(method string, url string, code int) bool {
-    client := &http.Client{
-        Transport: &http.Transport{
-            Proxy: http.ProxyFromEnvironment,
-        },
-        Timeout: time.Duration(5) * time.Second,
-    }
-    
-    request, err := http.NewRequest(method, url, nil)
-    if err != nil {
-        return false
-    }
-
-    resp, err := client.Do(request)
-    if err != nil {
-        return false
-    }
-    defer resp.Body.Close()
-
-    if resp.StatusCode == code {
-        return true
-    }
-
-    return false
-}
-
-func requestHttpFunc(method string, url string, data string, headers map[string]interface{}) (string, error) {
-    client := &http.Client{
-        Transport: &http.Transport{
-            Proxy: http.ProxyFromEnvironment,
-        },
-        Timeout: time.Duration(5) * time.Second,
-    }
-    
-    request, err := http.NewRequest(method, url, bytes.NewBufferString(data))
-    if err != nil {
-        return "", err
-    }
-
-    for key, val := range headers {
-        request.Header.Set(key, fmt.Sprintf("%v", val))
-    }
-
-    resp, err := client.Do(request)
-    if err != nil {
-        return "", err
-    }
-    defer resp.Body.Close()
-
-    body, err := ioutil.ReadAll(resp.Body)
-    if err != nil {
-        return "", err
-    }
-
-    return string(body), nil
-}
-
 // replaceAll replaces all occurrences of a value in a string with the given
 // replacement value.
 func replaceAll(f, t, s string) (string, error) {
@@ -207,48 +110,18 @@ func regexMatch(re, s string) (bool, error) {
     return compiled.MatchString(s), nil
 }
 
-// join is a version of strings.Join that can be piped
-func join(sep string, a []interface{}) (string, error) {
-    var arr []string
-    for _, v := range a {
-        arr = append(arr, v.(string))
-    }
-    return strings.Join(arr, sep), nil
-}
-
-func lookupIP(data string) []string {
-    ips, err := net.LookupIP(data)
+// join is a version of strings.Join that can be piped,
+// it accepts any list and formats its elements
+func join(sep string, a interface{}) (string, error) {
+    items, err := toList(a)
     if err != nil {
-        return nil
-    }
-    // "Cast" IPs into strings and sort the array
-    ipStrings := make([]string, len(ips))
-
-    for i, ip := range ips {
-        ipStrings[i] = ip.String()
-    }
-    sort.Strings(ipStrings)
-    return ipStrings
-}
-
-func lookupIPV6(data string) []string {
-    var addresses []string
-    for _, ip := range lookupIP(data) {
-        if strings.Contains(ip, ":") {
-            addresses = append(addresses, ip)
-        }
+        return "", err
     }
-    return addresses
-}
-
-func lookupIPV4(data string) []string {
-    var addresses []string
-    for _, ip := range lookupIP(data) {
-        if strings.Contains(ip, ".") {
-            addresses = append(addresses, ip)
-        }
+    arr := make([]string, len(items))
+    for i, v := range items {
+        arr[i] = fmt.Sprintf("%v", v)
     }
-    return addresses
+    return strings.Join(arr, sep), nil
 }
 
 func fileExist(f string) bool {
@@ -367,27 +240,11 @@ func set(m map[string]interface{}, key string, value interface{}) map[string]int
 }
 
 func getValueByPath(path string, obj interface{}) string {
-    parts := strings.Split(path, ".")
-    v := reflect.ValueOf(obj)
-
-    for _, part := range parts {
-        // Обработка указателей
-        for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
-            v = v.Elem()
-        }
-
-        if v.Kind() == reflect.Map {
-            v = v.MapIndex(reflect.ValueOf(part))
-        } else if v.Kind() == reflect.Struct {
-            v = v.FieldByName(part)
-        } else {
-            return ""
-        }
-
-        if !v.IsValid() {
-            return ""
-        }
+    value, ok := LookupPath(path, obj)
+    if !ok {
+        return ""
     }
+    v := reflect.ValueOf(value)
 
     // Если конечный результат — массив или срез
     if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
@@ -400,10 +257,32 @@ func getValueByPath(path string, obj interface{}) string {
         return strings.Join(strParts, ":")
     }
 
-    return fmt.Sprintf("%v", v.Interface())
+    return fmt.Sprintf("%v", value)
 }
 
-func sortByPath(path string, list []interface{}) []interface{} {
+// lessByPath compares the values by path as strings.
+func lessByPath(path string, a, b interface{}) bool {
+    return getValueByPath(path, a) < getValueByPath(path, b)
+}
+
+// lessByPathNum compares the values by path numerically if both are
+// numbers, numbers go before other values, which are compared as strings.
+func lessByPathNum(path string, a, b interface{}) bool {
+    valA := getValueByPath(path, a)
+    valB := getValueByPath(path, b)
+    x, errx := toNumber(valA)
+    y, erry := toNumber(valB)
+    switch {
+        case errx == nil && erry == nil:
+            return x < y
+        case errx == nil || erry == nil:
+            return errx == nil
+    }
+    return valA < valB
+}
+
+// sortList returns a sorted copy of the list.
+func sortList(list []interface{}, less func(a, b interface{}) bool) []interface{} {
     if len(list) <= 1 {
         return list
     }
@@ -412,10 +291,24 @@ func sortByPath(path string, list []interface{}) []interface{} {
     copy(result, list)
 
     sort.SliceStable(result, func(i, j int) bool {
-        valI := getValueByPath(path, result[i])
-        valJ := getValueByPath(path, result[j])
-        return valI < valJ
+        return less(result[i], result[j])
     })
 
     return result
 }
+
+func sortByPath(path string, list []interface{}) []interface{} {
+    return sortList(list, func(a, b interface{}) bool { return lessByPath(path, a, b) })
+}
+
+func sortByPathDesc(path string, list []interface{}) []interface{} {
+    return sortList(list, func(a, b interface{}) bool { return lessByPath(path, b, a) })
+}
+
+func sortByPathNum(path string, list []interface{}) []interface{} {
+    return sortList(list, func(a, b interface{}) bool { return lessByPathNum(path, a, b) })
+}
+
+func sortByPathNumDesc(path string, list []interface{}) []interface{} {
+    return sortList(list, func(a, b interface{}) bool { return lessByPathNum(path, b, a) })
+}
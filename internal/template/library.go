@@ -0,0 +1,428 @@
+package template
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "math"
+    "sort"
+    "reflect"
+    "strconv"
+    "strings"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/base64"
+    "gopkg.in/yaml.v3"
+)
+
+// toNumber converts ints, uints, floats and numeric strings to float64.
+func toNumber(v interface{}) (float64, error) {
+    rv := reflect.ValueOf(v)
+
+    switch rv.Kind() {
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            return float64(rv.Int()), nil
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+            return float64(rv.Uint()), nil
+        case reflect.Float32, reflect.Float64:
+            return rv.Float(), nil
+        case reflect.String:
+            f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+            if err != nil {
+                return 0, fmt.Errorf("%q is not a number", rv.String())
+            }
+            return f, nil
+    }
+
+    return 0, fmt.Errorf("%v (%T) is not a number", v, v)
+}
+
+// integer returns the value as int64 if it is an integer kind, an integer
+// string or an integral float, without losing precision of large integers.
+func integer(v interface{}) (int64, bool) {
+    rv := reflect.ValueOf(v)
+
+    switch rv.Kind() {
+        case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+            return rv.Int(), true
+        case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+            if u := rv.Uint(); u <= math.MaxInt64 {
+                return int64(u), true
+            }
+        case reflect.Float32, reflect.Float64:
+            if f := rv.Float(); isIntegral(f) {
+                return int64(f), true
+            }
+        case reflect.String:
+            if n, err := strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64); err == nil {
+                return n, true
+            }
+    }
+
+    return 0, false
+}
+
+// intArith applies the operation to integers, false if the result overflows int64.
+func intArith(op string, x, y int64) (int64, bool) {
+    switch op {
+        case "add":
+            s := x + y
+            return s, (y >= 0) == (s >= x)
+        case "sub":
+            s := x - y
+            return s, (y >= 0) == (s <= x)
+        case "mul":
+            if x == 0 || y == 0 {
+                return 0, true
+            }
+            s := x * y
+            return s, s/y == x && !(x == -1 && y == math.MinInt64) && !(y == -1 && x == math.MinInt64)
+        case "div":
+            return x / y, !(x == math.MinInt64 && y == -1)
+        case "mod":
+            if y == -1 {
+                return 0, true
+            }
+            return x % y, true
+    }
+    return 0, false
+}
+
+func isIntegral(f float64) bool {
+    return f == math.Trunc(f) && math.Abs(f) < 1<<53
+}
+
+// number returns the value as int64 if it is integral, float64 otherwise.
+func number(f float64) interface{} {
+    if isIntegral(f) {
+        return int64(f)
+    }
+    return f
+}
+
+// arith applies the operation to the numbers, integral operands
+// give integer division and remainder.
+func arith(op string, a, b interface{}) (interface{}, error) {
+    // Целые считаются без float64, чтобы не терять точность выше 2^53
+    if i, ok := integer(a); ok {
+        if j, ok := integer(b); ok {
+            if j == 0 && (op == "div" || op == "mod") {
+                return nil, fmt.Errorf("%s: division by zero", op)
+            }
+            if n, ok := intArith(op, i, j); ok {
+                return n, nil
+            }
+        }
+    }
+
+    x, err := toNumber(a)
+    if err != nil {
+        return nil, err
+    }
+    y, err := toNumber(b)
+    if err != nil {
+        return nil, err
+    }
+
+    switch op {
+        case "add":
+            return number(x + y), nil
+        case "sub":
+            return number(x - y), nil
+        case "mul":
+            return number(x * y), nil
+        case "div", "mod":
+            if y == 0 {
+                return nil, fmt.Errorf("%s: division by zero", op)
+            }
+            integral := isIntegral(x) && isIntegral(y)
+            if op == "mod" {
+                if integral {
+                    return int64(x) % int64(y), nil
+                }
+                return math.Mod(x, y), nil
+            }
+            if integral {
+                return int64(x) / int64(y), nil
+            }
+            return number(x / y), nil
+    }
+
+    return nil, fmt.Errorf("unknown operation %s", op)
+}
+
+func addFunc(a, b interface{}) (interface{}, error) { return arith("add", a, b) }
+func subFunc(a, b interface{}) (interface{}, error) { return arith("sub", a, b) }
+func mulFunc(a, b interface{}) (interface{}, error) { return arith("mul", a, b) }
+func divFunc(a, b interface{}) (interface{}, error) { return arith("div", a, b) }
+func modFunc(a, b interface{}) (interface{}, error) { return arith("mod", a, b) }
+
+// isEmpty reports whether the value is nil, false, zero or empty.
+func isEmpty(v interface{}) bool {
+    if v == nil {
+        return true
+    }
+    rv := reflect.ValueOf(v)
+    switch rv.Kind() {
+        case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+            return rv.Len() == 0
+        case reflect.Ptr, reflect.Interface:
+            return rv.IsNil()
+    }
+    return rv.IsZero()
+}
+
+// defaultFunc returns the value, or def if it is empty.
+func defaultFunc(def, v interface{}) interface{} {
+    if isEmpty(v) {
+        return def
+    }
+    return v
+}
+
+// toList converts any slice or array to []interface{}.
+func toList(v interface{}) ([]interface{}, error) {
+    if v == nil {
+        return nil, nil
+    }
+    if list, ok := v.([]interface{}); ok {
+        return list, nil
+    }
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+        return nil, fmt.Errorf("%T is not a list", v)
+    }
+    list := make([]interface{}, rv.Len())
+    for i := range list {
+        list[i] = rv.Index(i).Interface()
+    }
+    return list, nil
+}
+
+// sortedKeys returns the keys of the map sorted, as keys in templates.
+func sortedKeys(v interface{}) ([]string, error) {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Map {
+        return nil, fmt.Errorf("%T is not a map", v)
+    }
+    keys := make([]string, 0, rv.Len())
+    for _, k := range rv.MapKeys() {
+        keys = append(keys, fmt.Sprintf("%v", k.Interface()))
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// values returns the values of the map sorted by key.
+func values(v interface{}) ([]interface{}, error) {
+    rv := reflect.ValueOf(v)
+    if rv.Kind() != reflect.Map {
+        return nil, fmt.Errorf("%T is not a map", v)
+    }
+    mk := rv.MapKeys()
+    sort.Slice(mk, func(i, j int) bool {
+        return fmt.Sprintf("%v", mk[i].Interface()) < fmt.Sprintf("%v", mk[j].Interface())
+    })
+    list := make([]interface{}, len(mk))
+    for i, k := range mk {
+        list[i] = rv.MapIndex(k).Interface()
+    }
+    return list, nil
+}
+
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+    if len(pairs) % 2 != 0 {
+        return nil, fmt.Errorf("dict: odd number of arguments")
+    }
+    m := make(map[string]interface{}, len(pairs) / 2)
+    for i := 0; i < len(pairs); i += 2 {
+        m[fmt.Sprintf("%v", pairs[i])] = pairs[i+1]
+    }
+    return m, nil
+}
+
+func list(items ...interface{}) []interface{} {
+    return append([]interface{}{}, items...)
+}
+
+// LookupPath returns the value found by the dot separated path through
+// maps, indexes of lists and fields of structs, empty parts are skipped.
+func LookupPath(path string, v interface{}) (interface{}, bool) {
+    rv := reflect.ValueOf(v)
+
+    for _, part := range strings.Split(path, ".") {
+        if part == "" {
+            continue
+        }
+        for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+            rv = rv.Elem()
+        }
+
+        switch rv.Kind() {
+            case reflect.Map:
+                if rv.Type().Key().Kind() != reflect.String {
+                    return nil, false
+                }
+                rv = rv.MapIndex(reflect.ValueOf(part).Convert(rv.Type().Key()))
+            case reflect.Slice, reflect.Array:
+                i, err := strconv.Atoi(part)
+                if err != nil || i < 0 || i >= rv.Len() {
+                    return nil, false
+                }
+                rv = rv.Index(i)
+            case reflect.Struct:
+                rv = rv.FieldByName(part)
+            default:
+                return nil, false
+        }
+
+        if !rv.IsValid() {
+            return nil, false
+        }
+    }
+
+    if !rv.IsValid() {
+        return nil, true
+    }
+    return rv.Interface(), true
+}
+
+// get returns the value by the dot separated path, nil if it is not found.
+func get(path string, v interface{}) interface{} {
+    value, _ := LookupPath(path, v)
+    return value
+}
+
+// has reports whether the map has the dot separated path,
+// or the list has an element equal to the value.
+func has(key interface{}, v interface{}) bool {
+    if _, ok := v.(map[string]interface{}); ok {
+        _, found := LookupPath(fmt.Sprintf("%v", key), v)
+        return found
+    }
+    items, err := toList(v)
+    if err != nil {
+        return false
+    }
+    for _, item := range items {
+        if equal(item, key) {
+            return true
+        }
+    }
+    return false
+}
+
+// equal compares numbers by value and other values by their text.
+func equal(a, b interface{}) bool {
+    x, errx := toNumber(a)
+    y, erry := toNumber(b)
+    if errx == nil && erry == nil {
+        return x == y
+    }
+    return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
+
+func uniq(v interface{}) ([]interface{}, error) {
+    items, err := toList(v)
+    if err != nil {
+        return nil, err
+    }
+    var result []interface{}
+    for _, item := range items {
+        found := false
+        for _, r := range result {
+            if reflect.DeepEqual(r, item) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            result = append(result, item)
+        }
+    }
+    return result, nil
+}
+
+func sortAlpha(v interface{}) ([]string, error) {
+    items, err := toList(v)
+    if err != nil {
+        return nil, err
+    }
+    result := make([]string, len(items))
+    for i, item := range items {
+        result[i] = fmt.Sprintf("%v", item)
+    }
+    sort.Strings(result)
+    return result, nil
+}
+
+func trimAll(s, cutset string) string {
+    return strings.Trim(s, cutset)
+}
+
+func b64enc(s string) string {
+    return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func b64dec(s string) (string, error) {
+    data, err := base64.StdEncoding.DecodeString(s)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
+}
+
+func sha256sum(s string) string {
+    sum := sha256.Sum256([]byte(s))
+    return hex.EncodeToString(sum[:])
+}
+
+// indent prefixes every line of the string with n spaces.
+func indent(n interface{}, s string) (string, error) {
+    count, err := toInt(n)
+    if err != nil {
+        return "", err
+    }
+    if count < 0 {
+        return "", fmt.Errorf("indent: negative count %d", count)
+    }
+    pad := strings.Repeat(" ", int(count))
+    return pad + strings.Replace(s, "\n", "\n"+pad, -1), nil
+}
+
+// nindent is indent with a leading newline.
+func nindent(n interface{}, s string) (string, error) {
+    out, err := indent(n, s)
+    if err != nil {
+        return "", err
+    }
+    return "\n" + out, nil
+}
+
+func toYaml(v interface{}) (string, error) {
+    var b strings.Builder
+    enc := yaml.NewEncoder(&b)
+    enc.SetIndent(2)
+    if err := enc.Encode(v); err != nil {
+        return "", err
+    }
+    enc.Close()
+    return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// ipInCIDR reports whether the address belongs to the network.
+func ipInCIDR(cidr, ip string) (bool, error) {
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil {
+        return false, err
+    }
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false, fmt.Errorf("invalid IP address %q", ip)
+    }
+    return network.Contains(addr), nil
+}
+
+func env(name string) string {
+    return os.Getenv(name)
+}
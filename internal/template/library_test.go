@@ -0,0 +1,462 @@
+package template
+
+import (
+    "math"
+    "reflect"
+    "testing"
+)
+
+func TestToNumber(t *testing.T) {
+    tests := []struct {
+        in   interface{}
+        want float64
+        err  bool
+    }{
+        {3, 3, false},
+        {int64(-2), -2, false},
+        {uint8(7), 7, false},
+        {1.5, 1.5, false},
+        {float32(0.5), 0.5, false},
+        {"42", 42, false},
+        {" 2.5 ", 2.5, false},
+        {"-1e3", -1000, false},
+        {"abc", 0, true},
+        {"", 0, true},
+        {nil, 0, true},
+        {true, 0, true},
+        {[]interface{}{1}, 0, true},
+    }
+
+    for _, tt := range tests {
+        got, err := toNumber(tt.in)
+        if (err != nil) != tt.err {
+            t.Errorf("toNumber(%#v) error = %v, want error %v", tt.in, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("toNumber(%#v) = %v, want %v", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestArith(t *testing.T) {
+    tests := []struct {
+        op   string
+        a, b interface{}
+        want interface{}
+        err  bool
+    }{
+        // Числа из JSON приходят как float64, из ключей - как строки
+        {"add", 1, 2, int64(3), false},
+        {"add", 1.0, "2", int64(3), false},
+        {"add", "0.5", 1, 1.5, false},
+        {"sub", "10", 4.0, int64(6), false},
+        {"sub", 1, 1.5, -0.5, false},
+        {"mul", "3", "4", int64(12), false},
+        {"mul", 2.5, 2, int64(5), false},
+        {"div", 7, 2, int64(3), false},
+        {"div", 7.0, "2", int64(3), false},
+        {"div", 7.5, 2, 3.75, false},
+        {"div", 1, 0, nil, true},
+        {"div", "1", "0.0", nil, true},
+        {"mod", 7, "3", int64(1), false},
+        {"mod", 7.5, 2, 1.5, false},
+        {"mod", 7, 0, nil, true},
+        {"add", "x", 1, nil, true},
+        {"sub", 1, nil, nil, true},
+        {"mul", map[string]interface{}{}, 1, nil, true},
+        {"pow", 1, 1, nil, true},
+        // Целые выше 2^53 не проходят через float64
+        {"add", int64(1<<53 + 1), 1, int64(1<<53 + 2), false},
+        {"sub", "9007199254740993", "1", int64(9007199254740992), false},
+        {"mul", uint64(1<<40 + 1), 1 << 20, int64(1<<60 + 1<<20), false},
+        {"div", int64(1<<62 + 1), 1, int64(1<<62 + 1), false},
+        {"mul", int64(1 << 62), 4, float64(1 << 64), false},
+    }
+
+    for _, tt := range tests {
+        got, err := arith(tt.op, tt.a, tt.b)
+        if (err != nil) != tt.err {
+            t.Errorf("%s(%#v, %#v) error = %v, want error %v", tt.op, tt.a, tt.b, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s(%#v, %#v) = %#v, want %#v", tt.op, tt.a, tt.b, got, tt.want)
+        }
+    }
+
+    funcs := map[string]func(a, b interface{}) (interface{}, error){
+        "add": addFunc, "sub": subFunc, "mul": mulFunc, "div": divFunc, "mod": modFunc,
+    }
+    for op, fn := range funcs {
+        want, _ := arith(op, 9, "2")
+        if got, err := fn(9, "2"); err != nil || got != want {
+            t.Errorf("%sFunc(9, \"2\") = %v, %v, want %v", op, got, err, want)
+        }
+    }
+}
+
+func TestToIntFloat(t *testing.T) {
+    if v, err := toInt("12.7"); err != nil || v != 12 {
+        t.Errorf("toInt(\"12.7\") = %v, %v", v, err)
+    }
+    if v, err := toInt(3.0); err != nil || v != 3 {
+        t.Errorf("toInt(3.0) = %v, %v", v, err)
+    }
+    if v, err := toInt("9007199254740993"); err != nil || v != 9007199254740993 {
+        t.Errorf("toInt(\"9007199254740993\") = %v, %v", v, err)
+    }
+    if v, err := toInt(int64(1<<62 + 1)); err != nil || v != 1<<62+1 {
+        t.Errorf("toInt(1<<62 + 1) = %v, %v", v, err)
+    }
+    if _, err := toInt(1e300); err == nil {
+        t.Error("toInt(1e300) error = nil")
+    }
+    if _, err := toInt("x"); err == nil {
+        t.Error("toInt(\"x\") error = nil")
+    }
+    if v, err := toFloat("0.25"); err != nil || v != 0.25 {
+        t.Errorf("toFloat(\"0.25\") = %v, %v", v, err)
+    }
+    if _, err := toFloat(nil); err == nil {
+        t.Error("toFloat(nil) error = nil")
+    }
+}
+
+func TestEmptyDefault(t *testing.T) {
+    var nilMap map[string]interface{}
+    var nilPtr *int
+
+    tests := []struct {
+        in    interface{}
+        empty bool
+    }{
+        {nil, true},
+        {false, true},
+        {0, true},
+        {0.0, true},
+        {"", true},
+        {[]interface{}{}, true},
+        {map[string]interface{}{}, true},
+        {nilMap, true},
+        {nilPtr, true},
+        {true, false},
+        {1, false},
+        {"0", false},
+        {[]interface{}{nil}, false},
+        {map[string]interface{}{"a": nil}, false},
+    }
+
+    for _, tt := range tests {
+        if got := isEmpty(tt.in); got != tt.empty {
+            t.Errorf("isEmpty(%#v) = %v, want %v", tt.in, got, tt.empty)
+        }
+        want := tt.in
+        if tt.empty {
+            want = "def"
+        }
+        if got := defaultFunc("def", tt.in); !reflect.DeepEqual(got, want) {
+            t.Errorf("default(%#v) = %#v, want %#v", tt.in, got, want)
+        }
+    }
+}
+
+func TestMapHelpers(t *testing.T) {
+    m := map[string]interface{}{"b": 2, "a": 1, "c": 3}
+
+    keys, err := sortedKeys(m)
+    if err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+        t.Errorf("keys() = %v, %v", keys, err)
+    }
+    if keys, err := sortedKeys(map[int]string{2: "x", 1: "y"}); err != nil || !reflect.DeepEqual(keys, []string{"1", "2"}) {
+        t.Errorf("keys(map[int]) = %v, %v", keys, err)
+    }
+    if _, err := sortedKeys([]interface{}{}); err == nil {
+        t.Error("keys(list) error = nil")
+    }
+
+    vals, err := values(m)
+    if err != nil || !reflect.DeepEqual(vals, []interface{}{1, 2, 3}) {
+        t.Errorf("values() = %v, %v", vals, err)
+    }
+    if _, err := values("x"); err == nil {
+        t.Error("values(string) error = nil")
+    }
+
+    d, err := dict("a", 1, 2, "b")
+    if err != nil || !reflect.DeepEqual(d, map[string]interface{}{"a": 1, "2": "b"}) {
+        t.Errorf("dict() = %v, %v", d, err)
+    }
+    if _, err := dict("a"); err == nil {
+        t.Error("dict with odd arguments error = nil")
+    }
+    if d, err := dict(); err != nil || len(d) != 0 {
+        t.Errorf("dict() = %v, %v", d, err)
+    }
+}
+
+func TestListHelpers(t *testing.T) {
+    l := list(1, "a", nil)
+    if !reflect.DeepEqual(l, []interface{}{1, "a", nil}) {
+        t.Errorf("list() = %#v", l)
+    }
+    if l := list(); l == nil || len(l) != 0 {
+        t.Errorf("list() = %#v, want empty list", l)
+    }
+
+    if got, err := uniq([]interface{}{1, "a", 1, "a", 2.0}); err != nil || !reflect.DeepEqual(got, []interface{}{1, "a", 2.0}) {
+        t.Errorf("uniq() = %v, %v", got, err)
+    }
+    if got, err := uniq([]string{"x", "x"}); err != nil || !reflect.DeepEqual(got, []interface{}{"x"}) {
+        t.Errorf("uniq([]string) = %v, %v", got, err)
+    }
+    if _, err := uniq(1); err == nil {
+        t.Error("uniq(int) error = nil")
+    }
+
+    if got, err := sortAlpha([]interface{}{"b", 10, "a", 2}); err != nil || !reflect.DeepEqual(got, []string{"10", "2", "a", "b"}) {
+        t.Errorf("sortAlpha() = %v, %v", got, err)
+    }
+    if _, err := sortAlpha(map[string]interface{}{}); err == nil {
+        t.Error("sortAlpha(map) error = nil")
+    }
+
+    if got, err := join(",", []interface{}{"a", 1, 2.5}); err != nil || got != "a,1,2.5" {
+        t.Errorf("join() = %q, %v", got, err)
+    }
+    if got, err := join("-", []string{"x", "y"}); err != nil || got != "x-y" {
+        t.Errorf("join([]string) = %q, %v", got, err)
+    }
+    if _, err := join(",", "x"); err == nil {
+        t.Error("join(string) error = nil")
+    }
+}
+
+func TestGetHas(t *testing.T) {
+    data := map[string]interface{}{
+        "a": map[string]interface{}{"b": []interface{}{"x", "y"}, "n": nil},
+    }
+
+    tests := []struct {
+        path string
+        get  interface{}
+        has  bool
+    }{
+        {"a.b.1", "y", true},
+        {"a.n", nil, true},
+        {"a.c", nil, false},
+        {"a.b.5", nil, false},
+    }
+
+    for _, tt := range tests {
+        if got := get(tt.path, data); !reflect.DeepEqual(got, tt.get) {
+            t.Errorf("get(%q) = %#v, want %#v", tt.path, got, tt.get)
+        }
+        if got := has(tt.path, data); got != tt.has {
+            t.Errorf("has(%q) = %v, want %v", tt.path, got, tt.has)
+        }
+    }
+
+    // В списках значения сравниваются, числа - по значению
+    items := []interface{}{"a", 2.0, "3"}
+    for _, tt := range []struct {
+        key interface{}
+        has bool
+    }{{"a", true}, {2, true}, {"2", true}, {3, true}, {"b", false}} {
+        if got := has(tt.key, items); got != tt.has {
+            t.Errorf("has(%#v, list) = %v, want %v", tt.key, got, tt.has)
+        }
+    }
+    if has("a", "abc") {
+        t.Error("has(string) = true")
+    }
+}
+
+func TestSortByPath(t *testing.T) {
+    list := []interface{}{
+        map[string]interface{}{"name": "b", "prio": "10"},
+        map[string]interface{}{"name": "a", "prio": 9.0},
+        map[string]interface{}{"name": "c", "prio": 2},
+    }
+
+    names := func(l []interface{}) []string {
+        var out []string
+        for _, e := range l {
+            out = append(out, e.(map[string]interface{})["name"].(string))
+        }
+        return out
+    }
+
+    // sortByPath сравнивает строки, как и раньше
+    if got := names(sortByPath("prio", list)); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+        t.Errorf("sortByPath(prio) = %v", got)
+    }
+    if got := names(sortByPathDesc("prio", list)); !reflect.DeepEqual(got, []string{"a", "c", "b"}) {
+        t.Errorf("sortByPathDesc(prio) = %v", got)
+    }
+
+    // Числа в строках и float64 сравниваются как числа, остальные значения после них
+    mixed := append([]interface{}{map[string]interface{}{"name": "d", "prio": "high"}}, list...)
+    if got := names(sortByPathNum("prio", mixed)); !reflect.DeepEqual(got, []string{"c", "a", "b", "d"}) {
+        t.Errorf("sortByPathNum(prio) = %v", got)
+    }
+    if got := names(sortByPathNumDesc("prio", mixed)); !reflect.DeepEqual(got, []string{"d", "b", "a", "c"}) {
+        t.Errorf("sortByPathNumDesc(prio) = %v", got)
+    }
+    if got := names(sortByPath("name", list)); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+        t.Errorf("sortByPath(name) = %v", got)
+    }
+    if names(list)[0] != "b" {
+        t.Error("sortByPath modified the list")
+    }
+}
+
+func TestIndent(t *testing.T) {
+    // Числа из JSON приходят как float64
+    for _, n := range []interface{}{2, 2.0, "2"} {
+        if got, err := indent(n, "a\nb"); err != nil || got != "  a\n  b" {
+            t.Errorf("indent(%#v) = %q, %v", n, got, err)
+        }
+        if got, err := nindent(n, "a"); err != nil || got != "\n  a" {
+            t.Errorf("nindent(%#v) = %q, %v", n, got, err)
+        }
+    }
+    for _, n := range []interface{}{"x", -1, nil} {
+        if _, err := indent(n, "a"); err == nil {
+            t.Errorf("indent(%#v) error = nil", n)
+        }
+    }
+
+    out, err := New("t").Execute(`{{ .x | toYaml | nindent .n }}`, map[string]interface{}{"x": map[string]interface{}{"a": 1}, "n": 2.0})
+    if err != nil || string(out) != "\n  a: 1" {
+        t.Errorf("nindent with a JSON number = %q, %v", out, err)
+    }
+}
+
+func TestToToml(t *testing.T) {
+    tests := []struct {
+        name string
+        in   interface{}
+        want string
+        err  bool
+    }{
+        {
+            name: "values",
+            in: map[string]interface{}{
+                "s": "a \"q\"\n", "i": 3.0, "f": 1.5, "b": true,
+                "l": []interface{}{1, "x"}, "my key": "v",
+            },
+            want: "b = true\nf = 1.5\ni = 3\nl = [1, \"x\"]\n\"my key\" = \"v\"\ns = \"a \\\"q\\\"\\n\"",
+        },
+        {
+            name: "tables",
+            in: map[string]interface{}{
+                "top": 1,
+                "agent": map[string]interface{}{"interval": "10s"},
+                "outer": map[string]interface{}{"inner": map[string]interface{}{"k": "v"}},
+                "empty": map[string]interface{}{},
+            },
+            want: "top = 1\n\n[agent]\ninterval = \"10s\"\n\n[empty]\n\n[outer.inner]\nk = \"v\"",
+        },
+        {
+            name: "arrays of tables",
+            in: map[string]interface{}{
+                "inputs": []interface{}{
+                    map[string]interface{}{"name": "cpu"},
+                    map[string]interface{}{"name": "mem", "tags": map[string]interface{}{"a": "b"}},
+                },
+            },
+            want: "[[inputs]]\nname = \"cpu\"\n\n[[inputs]]\nname = \"mem\"\n\n[inputs.tags]\na = \"b\"",
+        },
+        {
+            name: "inline table",
+            in:   map[string]interface{}{"l": []interface{}{map[string]interface{}{"a": 1}, 2}},
+            want: "l = [{a = 1}, 2]",
+        },
+        {
+            name: "special floats",
+            in:   map[string]interface{}{"a": math.Inf(1), "b": math.Inf(-1), "c": math.NaN()},
+            want: "a = inf\nb = -inf\nc = nan",
+        },
+        {name: "null", in: map[string]interface{}{"a": map[string]interface{}{"b": nil}}, err: true},
+        {name: "unsupported", in: map[string]interface{}{"a": struct{}{}}, err: true},
+        {name: "not a map", in: []interface{}{1}, err: true},
+    }
+
+    for _, tt := range tests {
+        got, err := toToml(tt.in)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: toToml() error = %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: toToml() =\n%s\nwant\n%s", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestToTomlValue(t *testing.T) {
+    tests := []struct {
+        in   interface{}
+        want string
+        err  bool
+    }{
+        {"tab\there", `"tab\there"`, false},
+        {"\x01", `"\u0001"`, false},
+        {[]string{"a", "b"}, `["a", "b"]`, false},
+        {[]interface{}{}, `[]`, false},
+        {map[string]interface{}{"b": 1, "a": "x"}, `{a = "x", b = 1}`, false},
+        {2.0, "2", false},
+        {nil, "", true},
+        {[]interface{}{nil}, "", true},
+    }
+
+    for _, tt := range tests {
+        got, err := toTomlValue(tt.in)
+        if (err != nil) != tt.err || got != tt.want {
+            t.Errorf("toTomlValue(%#v) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.err)
+        }
+    }
+}
+
+func TestToIni(t *testing.T) {
+    tests := []struct {
+        name string
+        in   interface{}
+        want string
+        err  bool
+    }{
+        {
+            name: "sections",
+            in: map[string]interface{}{
+                "name": "app", "port": 8080.0, "debug": false, "hosts": []interface{}{"a", "b"},
+                "db": map[string]interface{}{"user": " admin", "opts": map[string]interface{}{"ssl": true}},
+            },
+            want: "debug = false\nhosts = a\nhosts = b\nname = app\nport = 8080\n\n[db]\nuser = \" admin\"\n\n[db.opts]\nssl = true",
+        },
+        {
+            name: "quoting",
+            in:   map[string]interface{}{"a": "x;y", "b": "q\"\n", "c": nil},
+            want: "a = \"x;y\"\nb = \"q\\\"\\n\"\nc =",
+        },
+        {name: "key", in: map[string]interface{}{"a=b": 1}, err: true},
+        {name: "section", in: map[string]interface{}{"a]": map[string]interface{}{"k": 1}}, err: true},
+        {name: "nested list", in: map[string]interface{}{"a": []interface{}{[]interface{}{1}}}, err: true},
+        {name: "not a map", in: "x", err: true},
+    }
+
+    for _, tt := range tests {
+        got, err := toIni(tt.in)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: toIni() error = %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: toIni() =\n%s\nwant\n%s", tt.name, got, tt.want)
+        }
+    }
+
+    if got, err := toJsonCompact(map[string]interface{}{"a": []interface{}{1, "x"}}); err != nil || got != `{"a":[1,"x"]}` {
+        t.Errorf("toJsonCompact() = %q, %v", got, err)
+    }
+}
@@ -0,0 +1,172 @@
+package template
+
+import (
+    "fmt"
+    "sort"
+    "bytes"
+    "io/ioutil"
+    "path/filepath"
+    "text/template/parse"
+)
+
+var (
+    // builtins are the functions of text/template.
+    builtins = map[string]bool{
+        "and": true, "or": true, "not": true, "len": true, "index": true, "slice": true,
+        "print": true, "printf": true, "println": true, "html": true, "js": true,
+        "urlquery": true, "call": true, "eq": true, "ne": true, "lt": true, "le": true,
+        "gt": true, "ge": true,
+    }
+)
+
+// Lint parses the template files matched by the glob (the file itself if
+// it is empty) and returns the problems found as "file:line:col: message":
+// syntax errors, unknown functions, functions disabled by the policy and
+// templates that are used but not defined.
+func Lint(name, glob string, policy *Policy) ([]string, error) {
+    if glob == "" {
+        glob = name
+    }
+    files, err := filepath.Glob(glob)
+    if err != nil {
+        return nil, err
+    }
+    if len(files) == 0 {
+        return nil, fmt.Errorf("no files match %s", glob)
+    }
+    if policy == nil {
+        policy = &Policy{}
+    }
+
+    funcs := New(name).funcMap
+    disabled := map[string]string{}
+    for group, names := range Groups {
+        if !policy.enabled(group) {
+            for _, n := range names {
+                disabled[n] = group
+            }
+        }
+    }
+
+    var problems []string
+    trees := map[string]*parse.Tree{}
+    found := false
+
+    for _, file := range files {
+        text, err := ioutil.ReadFile(file)
+        if err != nil {
+            return nil, err
+        }
+        if filepath.Base(file) == filepath.Base(name) {
+            found = true
+        }
+
+        // Неизвестные функции собираем при обходе дерева, а не при разборе
+        t := parse.New(filepath.Base(file))
+        t.Mode = parse.SkipFuncCheck
+        set := map[string]*parse.Tree{}
+        if _, err := t.Parse(string(text), "", "", set); err != nil {
+            problems = append(problems, fmt.Sprintf("%s: %v", file, err))
+            continue
+        }
+        for n, tree := range set {
+            tree.ParseName = file
+            trees[n] = tree
+        }
+    }
+
+    if !found {
+        problems = append(problems, fmt.Sprintf("%s: not matched by %s", name, glob))
+    }
+
+    names := make([]string, 0, len(trees))
+    for n := range trees {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+
+    for _, n := range names {
+        tree := trees[n]
+        walk(tree.Root, func(node parse.Node) {
+            switch nd := node.(type) {
+                case *parse.IdentifierNode:
+                    location, _ := tree.ErrorContext(nd)
+                    if group, ok := disabled[nd.Ident]; ok {
+                        problems = append(problems, fmt.Sprintf("%s: function %s is disabled, function group %q is not enabled by the template policy", location, nd.Ident, group))
+                    } else if _, ok := funcs[nd.Ident]; !ok && !builtins[nd.Ident] {
+                        problems = append(problems, fmt.Sprintf("%s: function %q not defined", location, nd.Ident))
+                    }
+                case *parse.TemplateNode:
+                    if tr, ok := trees[nd.Name]; !ok || tr.Root == nil {
+                        location, _ := tree.ErrorContext(nd)
+                        problems = append(problems, fmt.Sprintf("%s: template %q not defined", location, nd.Name))
+                    }
+            }
+        })
+    }
+
+    return problems, nil
+}
+
+// walk calls fn for the node and all nodes below it.
+func walk(node parse.Node, fn func(parse.Node)) {
+    if node == nil {
+        return
+    }
+    fn(node)
+
+    switch nd := node.(type) {
+        case *parse.ListNode:
+            if nd == nil {
+                return
+            }
+            for _, n := range nd.Nodes {
+                walk(n, fn)
+            }
+        case *parse.ActionNode:
+            walk(nd.Pipe, fn)
+        case *parse.PipeNode:
+            if nd == nil {
+                return
+            }
+            for _, c := range nd.Cmds {
+                walk(c, fn)
+            }
+        case *parse.CommandNode:
+            for _, a := range nd.Args {
+                walk(a, fn)
+            }
+        case *parse.ChainNode:
+            walk(nd.Node, fn)
+        case *parse.IfNode:
+            walkBranch(&nd.BranchNode, fn)
+        case *parse.RangeNode:
+            walkBranch(&nd.BranchNode, fn)
+        case *parse.WithNode:
+            walkBranch(&nd.BranchNode, fn)
+        case *parse.TemplateNode:
+            walk(nd.Pipe, fn)
+    }
+}
+
+func walkBranch(b *parse.BranchNode, fn func(parse.Node)) {
+    walk(b.Pipe, fn)
+    if b.List != nil {
+        walk(b.List, fn)
+    }
+    if b.ElseList != nil {
+        walk(b.ElseList, fn)
+    }
+}
+
+// MissingKeys returns the lines of the rendered output printing
+// "<no value>", i.e. a key missing in the data.
+func MissingKeys(out []byte) []int {
+    var lines []int
+    for i, line := range bytes.Split(out, []byte("\n")) {
+        if bytes.Contains(line, []byte("<no value>")) {
+            lines = append(lines, i+1)
+        }
+    }
+    return lines
+}
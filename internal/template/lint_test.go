@@ -0,0 +1,109 @@
+package template
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+func TestLint(t *testing.T) {
+    tests := []struct {
+        name   string
+        files  map[string]string
+        policy *Policy
+        want   []string
+    }{
+        {
+            name:  "valid",
+            files: map[string]string{
+                "main.tmpl": `{{ range .list }}{{ template "item" . }}{{ end }}{{ toUpper "a" | printf "%s" }}`,
+                "item.tmpl": `{{ define "item" }}{{ .name }}{{ end }}`,
+            },
+        },
+        {
+            name:  "syntax",
+            files: map[string]string{"main.tmpl": `{{ if .a }}`},
+            want:  []string{"main.tmpl: template: main.tmpl:1: unexpected EOF"},
+        },
+        {
+            name:  "unknown function",
+            files: map[string]string{"main.tmpl": "a\n{{ if .a }}{{ nosuch .b }}{{ end }}"},
+            want:  []string{`main.tmpl:2:14: function "nosuch" not defined`},
+        },
+        {
+            name:  "undefined template",
+            files: map[string]string{"main.tmpl": `{{ with .a }}{{ template "missing" . }}{{ end }}`},
+            want:  []string{`main.tmpl:1:25: template "missing" not defined`},
+        },
+        {
+            // По умолчанию функции окружения отключены
+            name:  "disabled function",
+            files: map[string]string{"main.tmpl": `{{ hostname }} {{ datetime }}`},
+            want:  []string{
+                `main.tmpl:1:3: function hostname is disabled, function group "host" is not enabled by the template policy`,
+                `main.tmpl:1:18: function datetime is disabled, function group "time" is not enabled by the template policy`,
+            },
+        },
+        {
+            name:   "enabled function",
+            files:  map[string]string{"main.tmpl": `{{ hostname }} {{ datetime }}`},
+            policy: &Policy{Groups: []string{"host", "time"}},
+        },
+    }
+
+    for _, tt := range tests {
+        dir := t.TempDir()
+        for name, text := range tt.files {
+            if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+                t.Fatal(err)
+            }
+        }
+
+        problems, err := Lint(filepath.Join(dir, "main.tmpl"), filepath.Join(dir, "*.tmpl"), tt.policy)
+        if err != nil {
+            t.Errorf("%s: Lint() error = %v", tt.name, err)
+            continue
+        }
+        for i := range problems {
+            problems[i] = strings.TrimPrefix(problems[i], dir+string(filepath.Separator))
+        }
+        if len(problems) != len(tt.want) {
+            t.Errorf("%s: Lint() = %q, want %q", tt.name, problems, tt.want)
+            continue
+        }
+        for i := range problems {
+            if !strings.HasPrefix(problems[i], tt.want[i]) {
+                t.Errorf("%s: Lint() = %q, want %q", tt.name, problems, tt.want)
+                break
+            }
+        }
+    }
+}
+
+func TestLintFiles(t *testing.T) {
+    dir := t.TempDir()
+    if _, err := Lint(filepath.Join(dir, "main.tmpl"), "", nil); err == nil {
+        t.Error("Lint() of no files error = nil")
+    }
+
+    ioutil.WriteFile(filepath.Join(dir, "other.tmpl"), []byte("x"), 0644)
+    problems, err := Lint(filepath.Join(dir, "main.tmpl"), filepath.Join(dir, "*.tmpl"), nil)
+    if err != nil || len(problems) != 1 || !strings.Contains(problems[0], "not matched by") {
+        t.Errorf("Lint() = %q, %v, want main.tmpl not matched", problems, err)
+    }
+}
+
+func TestMissingKeys(t *testing.T) {
+    out, err := New("t").Execute("a = {{ .a }}\nb = {{ .b }}\nc = {{ .c.d }}\n", map[string]interface{}{"a": 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if lines := MissingKeys(out); !reflect.DeepEqual(lines, []int{2, 3}) {
+        t.Errorf("MissingKeys() = %v, want [2 3]", lines)
+    }
+    if lines := MissingKeys([]byte("a = 1\n")); lines != nil {
+        t.Errorf("MissingKeys() = %v, want none", lines)
+    }
+}
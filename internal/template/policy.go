@@ -0,0 +1,265 @@
+package template
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "time"
+    "bytes"
+    "context"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "path"
+)
+
+const (
+    // DefaultTimeout bounds the total render time of a template.
+    DefaultTimeout = 30 * time.Second
+    // requestTimeout bounds a single HTTP request of a template.
+    requestTimeout = 5 * time.Second
+)
+
+var (
+    // Groups are the functions depending on the environment of the render,
+    // they can be enabled by the policy.
+    Groups = map[string][]string{
+        "network": {"connectHttp", "requestHttp"},
+        "dns":     {"lookupIPV4", "lookupIPV6"},
+        "file":    {"fileExist"},
+        "host":    {"hostname", "env"},
+        "time":    {"datetime"},
+    }
+)
+
+// Policy restricts the functions available to a template.
+type Policy struct {
+    // Groups are the enabled function groups, none by default
+    Groups         []string
+    // Hosts are the allowed hosts of URLs (host or host:port, * wildcards), none by default
+    Hosts          []string
+    // Methods are the allowed HTTP methods besides GET
+    Methods        []string
+    // Timeout bounds the total render time, DefaultTimeout if zero
+    Timeout        time.Duration
+}
+
+// Strict is the policy of templates rendered on a server: no functions
+// depending on the environment are available.
+var Strict = &Policy{ Timeout: 5 * time.Second }
+
+// Validate checks the groups, hosts and methods of the policy.
+func (p *Policy) Validate() error {
+    for _, g := range p.Groups {
+        if _, ok := Groups[g]; !ok {
+            return fmt.Errorf("unknown function group %q", g)
+        }
+    }
+    for _, h := range p.Hosts {
+        if _, err := path.Match(h, ""); err != nil || h == "" {
+            return fmt.Errorf("invalid host %q", h)
+        }
+    }
+    for _, m := range p.Methods {
+        if m == "" || strings.ToUpper(m) != m {
+            return fmt.Errorf("invalid method %q, must be upper case", m)
+        }
+    }
+    if p.Timeout < 0 {
+        return fmt.Errorf("invalid timeout %v", p.Timeout)
+    }
+    if p.enabled("network") && len(p.Hosts) == 0 {
+        return fmt.Errorf("function group \"network\" requires the allowed hosts")
+    }
+    return nil
+}
+
+func (p *Policy) enabled(group string) bool {
+    for _, g := range p.Groups {
+        if g == group {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *Policy) timeout() time.Duration {
+    if p.Timeout == 0 {
+        return DefaultTimeout
+    }
+    return p.Timeout
+}
+
+// checkRequest returns an error if the request is not allowed by the policy.
+func (p *Policy) checkRequest(method, rawurl string) error {
+    if method != http.MethodGet {
+        allowed := false
+        for _, m := range p.Methods {
+            if m == method {
+                allowed = true
+            }
+        }
+        if !allowed {
+            return fmt.Errorf("method %s is not allowed by the template policy", method)
+        }
+    }
+
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return err
+    }
+    for _, h := range p.Hosts {
+        if ok, _ := path.Match(h, u.Host); ok {
+            return nil
+        }
+        if ok, _ := path.Match(h, u.Hostname()); ok {
+            return nil
+        }
+    }
+    return fmt.Errorf("host %s is not allowed by the template policy", u.Host)
+}
+
+// disabled returns the replacement of a function disabled by the policy.
+func disabled(name, group string) func(...interface{}) (interface{}, error) {
+    return func(...interface{}) (interface{}, error) {
+        return nil, fmt.Errorf("function %s is disabled, function group %q is not enabled by the template policy", name, group)
+    }
+}
+
+type memoEntry struct {
+    value          interface{}
+    err            error
+}
+
+// memo returns the result of fn stored by key during the render.
+func (t *Template) memo(key string, fn func() (interface{}, error)) (interface{}, error) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if e, ok := t.results[key]; ok {
+        return e.value, e.err
+    }
+    v, err := fn()
+    t.results[key] = memoEntry{ value: v, err: err }
+    return v, err
+}
+
+func (t *Template) request(method, rawurl, data string, headers map[string]interface{}) (int, string, error) {
+    ctx, cancel := context.WithTimeout(t.ctx, requestTimeout)
+    defer cancel()
+
+    request, err := http.NewRequestWithContext(ctx, method, rawurl, bytes.NewBufferString(data))
+    if err != nil {
+        return 0, "", err
+    }
+    for key, val := range headers {
+        request.Header.Set(key, fmt.Sprintf("%v", val))
+    }
+
+    client := &http.Client{
+        Transport: &http.Transport{
+            Proxy: http.ProxyFromEnvironment,
+        },
+        // Перенаправления проверяются политикой так же, как исходный запрос
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) >= 10 {
+                return fmt.Errorf("stopped after 10 redirects")
+            }
+            return t.policy.checkRequest(req.Method, req.URL.String())
+        },
+    }
+    resp, err := client.Do(request)
+    if err != nil {
+        return 0, "", err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return 0, "", err
+    }
+    return resp.StatusCode, string(body), nil
+}
+
+func requestKey(kind, method, rawurl, data string, headers map[string]interface{}) string {
+    keys := make([]string, 0, len(headers))
+    for k := range headers {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    var b strings.Builder
+    b.WriteString(kind + "\x00" + method + "\x00" + rawurl + "\x00" + data)
+    for _, k := range keys {
+        fmt.Fprintf(&b, "\x00%s=%v", k, headers[k])
+    }
+    return b.String()
+}
+
+// connectHttp reports whether the request to the URL answers with the code.
+func (t *Template) connectHttp(method string, rawurl string, code int) (bool, error) {
+    if err := t.policy.checkRequest(method, rawurl); err != nil {
+        return false, err
+    }
+    v, _ := t.memo(requestKey("connect", method, rawurl, "", nil), func() (interface{}, error) {
+        status, _, err := t.request(method, rawurl, "", nil)
+        if err != nil {
+            return 0, nil
+        }
+        return status, nil
+    })
+    return v.(int) == code, nil
+}
+
+// requestHttp returns the body of the response to the request.
+func (t *Template) requestHttp(method string, rawurl string, data string, headers map[string]interface{}) (string, error) {
+    if err := t.policy.checkRequest(method, rawurl); err != nil {
+        return "", err
+    }
+    v, err := t.memo(requestKey("request", method, rawurl, data, headers), func() (interface{}, error) {
+        _, body, err := t.request(method, rawurl, data, headers)
+        return body, err
+    })
+    if err != nil {
+        return "", err
+    }
+    return v.(string), nil
+}
+
+// lookupIP returns the sorted addresses of the host, nil if it is not resolved.
+func (t *Template) lookupIP(host string) []string {
+    v, _ := t.memo("lookup\x00"+host, func() (interface{}, error) {
+        addrs, err := net.DefaultResolver.LookupIPAddr(t.ctx, host)
+        if err != nil {
+            return []string(nil), nil
+        }
+        ips := make([]string, len(addrs))
+        for i, addr := range addrs {
+            ips[i] = addr.IP.String()
+        }
+        sort.Strings(ips)
+        return ips, nil
+    })
+    return v.([]string)
+}
+
+func (t *Template) lookupIPV6(host string) []string {
+    var addresses []string
+    for _, ip := range t.lookupIP(host) {
+        if strings.Contains(ip, ":") {
+            addresses = append(addresses, ip)
+        }
+    }
+    return addresses
+}
+
+func (t *Template) lookupIPV4(host string) []string {
+    var addresses []string
+    for _, ip := range t.lookupIP(host) {
+        if strings.Contains(ip, ".") {
+            addresses = append(addresses, ip)
+        }
+    }
+    return addresses
+}
@@ -0,0 +1,123 @@
+package template
+
+import (
+    "time"
+    "runtime"
+    "strings"
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+func TestPolicyValidate(t *testing.T) {
+    tests := []struct {
+        policy Policy
+        err    bool
+    }{
+        {Policy{}, false},
+        {Policy{Groups: []string{"dns", "time"}}, false},
+        {Policy{Groups: []string{"network"}, Hosts: []string{"*.example.com"}}, false},
+        // Сеть без списка хостов не включается
+        {Policy{Groups: []string{"network"}}, true},
+        {Policy{Groups: []string{"unknown"}}, true},
+        {Policy{Hosts: []string{"["}}, true},
+        {Policy{Methods: []string{"put"}}, true},
+        {Policy{Timeout: -time.Second}, true},
+    }
+
+    for _, tt := range tests {
+        if err := tt.policy.Validate(); (err != nil) != tt.err {
+            t.Errorf("%+v: Validate() = %v, want error %v", tt.policy, err, tt.err)
+        }
+    }
+}
+
+func TestPolicyDefault(t *testing.T) {
+    for _, p := range []*Policy{nil, {}, {Groups: []string{}}} {
+        for _, fn := range []string{"hostname", "datetime", "fileExist", "lookupIPV4", "connectHttp"} {
+            src := "{{ " + fn + " }}"
+            _, err := New("t").WithPolicy(p).Execute(src, nil)
+            if err == nil || !strings.Contains(err.Error(), "is disabled") {
+                t.Errorf("%+v: %s error = %v, want disabled", p, fn, err)
+            }
+        }
+    }
+
+    p := &Policy{Groups: []string{"time"}}
+    if _, err := New("t").WithPolicy(p).Execute("{{ datetime }}", nil); err != nil {
+        t.Errorf("datetime with the time group: %v", err)
+    }
+}
+
+func TestCheckRequest(t *testing.T) {
+    p := &Policy{Hosts: []string{"127.0.0.1:*", "*.example.com"}, Methods: []string{"PUT"}}
+
+    tests := []struct {
+        method string
+        url    string
+        err    bool
+    }{
+        {"GET", "http://127.0.0.1:8080/", false},
+        {"PUT", "http://api.example.com/x", false},
+        {"POST", "http://api.example.com/x", true},
+        {"GET", "http://localhost:8080/", true},
+        {"GET", "http://example.org/", true},
+    }
+
+    for _, tt := range tests {
+        if err := p.checkRequest(tt.method, tt.url); (err != nil) != tt.err {
+            t.Errorf("%s %s: checkRequest() = %v, want error %v", tt.method, tt.url, err, tt.err)
+        }
+    }
+
+    if err := (&Policy{}).checkRequest("GET", "http://127.0.0.1/"); err == nil {
+        t.Error("empty hosts allow the request")
+    }
+}
+
+func TestRedirectChecked(t *testing.T) {
+    hits := 0
+    target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        hits++
+        w.Write([]byte("secret"))
+    }))
+    defer target.Close()
+
+    // Перенаправление на хост, не разрешённый политикой
+    redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Redirect(w, r, strings.Replace(target.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+    }))
+    defer redirect.Close()
+
+    p := &Policy{Groups: []string{"network"}, Hosts: []string{"127.0.0.1:*"}}
+    src := `{{ requestHttp "GET" .url "" nil }}`
+    out, err := New("t").WithPolicy(p).Execute(src, map[string]interface{}{"url": redirect.URL})
+    if err == nil || !strings.Contains(err.Error(), "not allowed") {
+        t.Errorf("Execute() = %q, %v, want not allowed host", out, err)
+    }
+    if hits != 0 {
+        t.Errorf("redirect target got %d requests", hits)
+    }
+}
+
+func TestTimeoutStops(t *testing.T) {
+    list := make([]interface{}, 10000)
+    data := map[string]interface{}{"list": list}
+    src := `{{ range .list }}{{ range $.list }}{{ $x := toUpper "a" }}{{ end }}{{ end }}`
+
+    before := runtime.NumGoroutine()
+    p := &Policy{Timeout: 50 * time.Millisecond}
+    _, err := New("t").WithPolicy(p).Execute(src, data)
+    if err == nil || !strings.Contains(err.Error(), "render time exceeded") {
+        t.Fatalf("Execute() error = %v, want render time exceeded", err)
+    }
+
+    // Выполнение шаблона останавливается после истечения времени
+    deadline := time.Now().Add(time.Second)
+    for runtime.NumGoroutine() > before {
+        if time.Now().After(deadline) {
+            t.Fatal("template is still executed after the timeout")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
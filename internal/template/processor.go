@@ -2,8 +2,13 @@ package template
 
 import (
     //"log"
+    "io"
+    "fmt"
     "strings"
+    "sync"
     "time"
+    "context"
+    "reflect"
     "text/template"
     "path/filepath"
     "bytes"
@@ -17,11 +22,17 @@ type Template struct {
     template  *template.Template
     funcMap   template.FuncMap
     name      string
+    policy    *Policy
+    ctx       context.Context
+    lock      sync.Mutex
+    results   map[string]memoEntry
 }
 
+// New returns the template with the default policy: no function groups,
+// no hosts, GET requests only.
 func New(name string) *Template {
 
-    var t Template
+    t := &Template{ policy: &Policy{}, ctx: context.Background(), results: map[string]memoEntry{} }
     t.funcMap = template.FuncMap{
         "isArray":         isArray,
         "isSlice":         isSlice,
@@ -45,17 +56,17 @@ func New(name string) *Template {
         "contains":        strings.Contains,
         "replace":         strings.Replace,
         "trimSuffix":      strings.TrimSuffix,
-        "sub":             func(a, b int) int { return a - b },
-        "div":             func(a, b int) int { return a / b },
-        "mod":             func(a, b int) int { return a % b },
-        "mul":             func(a, b int) int { return a * b },
-        "connectHttp":     connectHttpFunc,
-        "requestHttp":     requestHttpFunc,
+        "sub":             subFunc,
+        "div":             divFunc,
+        "mod":             modFunc,
+        "mul":             mulFunc,
+        "connectHttp":     t.connectHttp,
+        "requestHttp":     t.requestHttp,
         "regexReplaceAll": regexReplaceAll,
         "regexMatch":      regexMatch,
         "replaceAll":      replaceAll,
-        "lookupIPV4":      lookupIPV4,
-        "lookupIPV6":      lookupIPV6,
+        "lookupIPV4":      t.lookupIPV4,
+        "lookupIPV6":      t.lookupIPV6,
         "fileExist":       fileExist,
         "hostname":        hostname,
         "fromJson":        fromJson,
@@ -65,12 +76,122 @@ func New(name string) *Template {
         "deepCopy":        deepCopy,
         "set":             set,
         "sortByPath":      sortByPath,
+        "sortByPathDesc":  sortByPathDesc,
+        "sortByPathNum":   sortByPathNum,
+        "sortByPathNumDesc": sortByPathNumDesc,
+        "default":         defaultFunc,
+        "empty":           isEmpty,
+        "keys":            sortedKeys,
+        "values":          values,
+        "dict":            dict,
+        "list":            list,
+        "has":             has,
+        "get":             get,
+        "trim":            strings.TrimSpace,
+        "trimAll":         trimAll,
+        "trimPrefix":      strings.TrimPrefix,
+        "b64enc":          b64enc,
+        "b64dec":          b64dec,
+        "sha256":          sha256sum,
+        "toYaml":          toYaml,
+        "toToml":          toToml,
+        "toTomlValue":     toTomlValue,
+        "toIni":           toIni,
+        "toJsonCompact":   toJsonCompact,
+        "indent":          indent,
+        "nindent":         nindent,
+        "uniq":            uniq,
+        "sortAlpha":       sortAlpha,
+        "ipInCIDR":        ipInCIDR,
+        "env":             env,
+    }
+
+    for n, fn := range t.funcMap {
+        t.funcMap[n] = t.guard(fn)
     }
 
     t.name = filepath.Base(name)
     t.template = template.New(t.name).Funcs(t.funcMap)
 
-    return &t
+    return t.WithPolicy(&Policy{})
+}
+
+// guard returns fn failing the execution once the render time is exceeded,
+// text/template turns the panic of a function into an execution error.
+func (t *Template) guard(fn interface{}) interface{} {
+    v := reflect.ValueOf(fn)
+    return reflect.MakeFunc(v.Type(), func(args []reflect.Value) []reflect.Value {
+        if err := t.ctx.Err(); err != nil {
+            panic(err)
+        }
+        if v.Type().IsVariadic() {
+            return v.CallSlice(args)
+        }
+        return v.Call(args)
+    }).Interface()
+}
+
+// WithPolicy restricts the functions of the template, it must be called before parsing.
+func (t *Template) WithPolicy(policy *Policy) *Template {
+    if policy == nil {
+        return t
+    }
+    t.policy = policy
+
+    funcs := template.FuncMap{}
+    for group, names := range Groups {
+        for _, name := range names {
+            if policy.enabled(group) {
+                funcs[name] = t.funcMap[name]
+            } else {
+                funcs[name] = disabled(name, group)
+            }
+        }
+    }
+    t.template.Funcs(funcs)
+
+    return t
+}
+
+// execute runs the template within the render time of the policy,
+// network results are reused during the run.
+func (t *Template) execute(fn func(w io.Writer) error) ([]byte, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), t.policy.timeout())
+    defer cancel()
+
+    t.ctx = ctx
+    t.results = map[string]memoEntry{}
+
+    var b bytes.Buffer
+    done := make(chan error, 1)
+    go func() {
+        // Выполнение прерывается при следующей записи или вызове функции
+        // после истечения времени, запросы функций отменяются контекстом
+        done <- fn(&deadlineWriter{ ctx: ctx, w: &b })
+    }()
+
+    select {
+        case err := <-done:
+            if err != nil {
+                return nil, errors.Wrap(err, "execute")
+            }
+            return b.Bytes(), nil
+        case <-ctx.Done():
+            return nil, fmt.Errorf("execute: render time exceeded %v", t.policy.timeout())
+    }
+}
+
+// deadlineWriter fails the writes after the context is done.
+type deadlineWriter struct {
+    ctx       context.Context
+    w         io.Writer
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+    if err := d.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return d.w.Write(p)
 }
 
 func (t *Template) Execute(source string, jsn interface{}) ([]byte, error) {
@@ -81,12 +202,9 @@ func (t *Template) Execute(source string, jsn interface{}) ([]byte, error) {
     }
 
     // Execute the template into the writer
-    var b bytes.Buffer
-    if err := tmpl.Execute(&b, &jsn); err != nil {
-        return nil, errors.Wrap(err, "execute")
-    }
-
-    return b.Bytes(), nil
+    return t.execute(func(w io.Writer) error {
+        return tmpl.Execute(w, &jsn)
+    })
 }
 
 func (t *Template) ParseGlob(source string, jsn interface{}) ([]byte, error) {
@@ -97,10 +215,7 @@ func (t *Template) ParseGlob(source string, jsn interface{}) ([]byte, error) {
     }
 
     // Execute the template into the writer
-    var b bytes.Buffer
-    if err := tmpl.ExecuteTemplate(&b, t.name, &jsn); err != nil {
-        return nil, errors.Wrap(err, "execute")
-    }
-
-    return b.Bytes(), nil
+    return t.execute(func(w io.Writer) error {
+        return tmpl.ExecuteTemplate(w, t.name, &jsn)
+    })
 }
@@ -0,0 +1,47 @@
+package template
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+)
+
+// Item is an element of a collection returned by Select.
+type Item struct {
+    Key       string
+    Value     interface{}
+}
+
+// Select returns the elements of the collection found by the dot separated path,
+// elements of a map are sorted by key, elements of an array are keyed by index.
+// An empty path selects the data itself.
+func Select(path string, jsn interface{}) ([]Item, error) {
+
+    v, ok := LookupPath(path, jsn)
+    if !ok {
+        return nil, fmt.Errorf("%q not found", path)
+    }
+
+    var items []Item
+
+    switch val := v.(type) {
+        case map[string]interface{}:
+            keys := make([]string, 0, len(val))
+            for k := range val {
+                keys = append(keys, k)
+            }
+            sort.Strings(keys)
+            for _, k := range keys {
+                items = append(items, Item{ Key: k, Value: val[k] })
+            }
+        case []interface{}:
+            for i, e := range val {
+                items = append(items, Item{ Key: strconv.Itoa(i), Value: e })
+            }
+        case nil:
+        default:
+            return nil, fmt.Errorf("%q is not a collection", path)
+    }
+
+    return items, nil
+}
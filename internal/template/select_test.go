@@ -0,0 +1,68 @@
+package template
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestLookupPath(t *testing.T) {
+    type host struct {
+        Name string
+    }
+    data := map[string]interface{}{
+        "a": map[string]interface{}{
+            "b": []interface{}{"x", map[string]interface{}{"c": 1}},
+            "n": nil,
+        },
+        "s": map[string]string{"k": "v"},
+        "h": host{Name: "h1"},
+    }
+
+    tests := []struct {
+        path  string
+        value interface{}
+        found bool
+    }{
+        {"", data, true},
+        {"a.b.0", "x", true},
+        {"a.b.1.c", 1, true},
+        {"a.n", nil, true},
+        {"s.k", "v", true},
+        {"h.Name", "h1", true},
+        {"a.b.2", nil, false},
+        {"a.b.x", nil, false},
+        {"a.missing", nil, false},
+        {"a.b.0.c", nil, false},
+        {"a.n.c", nil, false},
+    }
+
+    for _, tt := range tests {
+        value, found := LookupPath(tt.path, data)
+        if found != tt.found || !reflect.DeepEqual(value, tt.value) {
+            t.Errorf("LookupPath(%q) = %v, %v, want %v, %v", tt.path, value, found, tt.value, tt.found)
+        }
+    }
+}
+
+func TestSelect(t *testing.T) {
+    data := map[string]interface{}{
+        "hosts": map[string]interface{}{"b": 2, "a": 1},
+        "list":  []interface{}{"x", "y"},
+        "name":  "n",
+    }
+
+    items, err := Select("hosts", data)
+    if err != nil || len(items) != 2 || items[0].Key != "a" || items[1].Value != 2 {
+        t.Errorf("Select(hosts) = %+v, %v", items, err)
+    }
+    items, err = Select("list", data)
+    if err != nil || len(items) != 2 || items[1].Key != "1" || items[1].Value != "y" {
+        t.Errorf("Select(list) = %+v, %v", items, err)
+    }
+    if _, err := Select("name", data); err == nil {
+        t.Error("Select(name) of a string does not fail")
+    }
+    if _, err := Select("missing", data); err == nil {
+        t.Error("Select(missing) does not fail")
+    }
+}